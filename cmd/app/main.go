@@ -1,10 +1,17 @@
 package main
 
 import (
+	"log"
+
 	"github.com/vladNed/hyperspace/internal/server"
 )
 
 func main() {
-	server := server.NewServer()
-	server.Run()
+	server, err := server.NewServer()
+	if err != nil {
+		log.Fatalln("cannot start server:", err)
+	}
+	if err := server.Run(); err != nil {
+		log.Fatalln("server stopped:", err)
+	}
 }
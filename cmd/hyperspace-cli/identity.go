@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	SHARED_KEY_SIZE = 32
+	IV_SIZE         = 12
+)
+
+// Public key in the JWK shape exported by WebCrypto in
+// `web/static/ts/lib/auth.ts`.
+type jsonWebKey struct {
+	Crv    string   `json:"crv"`
+	Ext    bool     `json:"ext"`
+	KeyOps []string `json:"key_ops"`
+	Kty    string   `json:"kty"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+}
+
+// Identity is the ECDH P-384 key pair of this peer. Once the remote public
+// key is known it derives the AES-GCM key used to encrypt everything sent
+// over the data channel, exactly like the browser `Identity`. A separate
+// ECDSA P-384 key pair signs the offer and answer.
+type Identity struct {
+	privateKey *ecdh.PrivateKey
+	signingKey *ecdsa.PrivateKey
+	aead       cipher.AEAD
+}
+
+func NewIdentity() (*Identity, error) {
+	privateKey, err := ecdh.P384().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privateKey: privateKey, signingKey: signingKey}, nil
+}
+
+// Exports the public key as base64 encoded JWK JSON, the format the browser
+// expects in `pubKey`.
+func (id *Identity) ExportPubKey() (string, error) {
+	point := id.privateKey.PublicKey().Bytes()
+	coordSize := (len(point) - 1) / 2
+	jwk := jsonWebKey{
+		Crv:    "P-384",
+		Ext:    true,
+		KeyOps: []string{},
+		Kty:    "EC",
+		X:      base64.RawURLEncoding.EncodeToString(point[1 : 1+coordSize]),
+		Y:      base64.RawURLEncoding.EncodeToString(point[1+coordSize:]),
+	}
+
+	jwkRaw, err := json.MarshalIndent(jwk, "", " ")
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(jwkRaw), nil
+}
+
+// Signs the offer and answer, its public key is advertised in
+// `signingKey` next to the ECDH `pubKey`.
+func (id *Identity) Signer() crypto.Signer {
+	return id.signingKey
+}
+
+// Derives the shared AES-256-GCM key from the peer public key. WebCrypto
+// keeps the leftmost 256 bits of the ECDH secret, so the same is done here.
+func (id *Identity) DeriveSharedSecret(pubKey string) error {
+	remoteKey, err := importPubKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	secret, err := id.privateKey.ECDH(remoteKey)
+	if err != nil {
+		return fmt.Errorf("cannot derive shared secret: %w", err)
+	}
+
+	block, err := aes.NewCipher(secret[:SHARED_KEY_SIZE])
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	id.aead = aead
+	return nil
+}
+
+// Encrypts the data and prefixes it with the random IV.
+func (id *Identity) Encrypt(data []byte) ([]byte, error) {
+	if id.aead == nil {
+		return nil, errors.New("shared secret not derived")
+	}
+
+	iv := make([]byte, IV_SIZE)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return id.aead.Seal(iv, iv, data, nil), nil
+}
+
+func (id *Identity) Decrypt(data []byte) ([]byte, error) {
+	if id.aead == nil {
+		return nil, errors.New("shared secret not derived")
+	}
+	if len(data) < IV_SIZE {
+		return nil, errors.New("encrypted message too short")
+	}
+	return id.aead.Open(nil, data[:IV_SIZE], data[IV_SIZE:], nil)
+}
+
+func importPubKey(pubKey string) (*ecdh.PublicKey, error) {
+	jwkRaw, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+
+	var jwk jsonWebKey
+	if err := json.Unmarshal(jwkRaw, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-384" {
+		return nil, fmt.Errorf("unsupported public key %s/%s", jwk.Kty, jwk.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	point := append([]byte{0x04}, x...)
+	point = append(point, y...)
+	return ecdh.P384().NewPublicKey(point)
+}
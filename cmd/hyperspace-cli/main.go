@@ -0,0 +1,369 @@
+// Command hyperspace-cli sends and receives files from a terminal using the
+// same signaling protocol, encryption and data channel format as the
+// SafeFiles browser client, so either side can be a browser.
+//
+//	hyperspace-cli send [flags] FILE...
+//	hyperspace-cli receive [flags] SESSION_ID
+//
+// The sender creates the session and prints its id. The receiver joins it
+// and prints a PIN which the sender has to enter to accept the connection.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/vladNed/hyperspace/internal/utils"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+const DEFAULT_SERVER = "ws://localhost:8080/ws/v1/session/"
+
+type options struct {
+	server  string
+	origin  string
+	timeout time.Duration
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "send":
+		err = runSend(ctx, os.Args[2:])
+	case "receive":
+		err = runReceive(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hyperspace-cli send [flags] FILE...")
+	fmt.Fprintln(os.Stderr, "       hyperspace-cli receive [flags] SESSION_ID")
+	os.Exit(2)
+}
+
+func commonFlags(name string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.server, "server", DEFAULT_SERVER, "signaling websocket url")
+	flags.StringVar(&opts.origin, "origin", "", "origin header, derived from -server when empty")
+	flags.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "how long to wait for the peer")
+	return flags
+}
+
+func runSend(ctx context.Context, args []string) error {
+	var opts options
+	var sessionId string
+	var ttl time.Duration
+	flags := commonFlags("send", &opts)
+	flags.StringVar(&sessionId, "session", "", "session id to create, random when empty")
+	flags.DurationVar(&ttl, "ttl", 0, "session lifetime to ask the server for, its default when zero")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		usage()
+	}
+	if sessionId == "" {
+		sessionId = utils.GetSessionId()
+	}
+
+	identity, err := NewIdentity()
+	if err != nil {
+		return err
+	}
+	peer, err := NewPeer(true)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	client, err := dialSignaling(ctx, opts, peer)
+	if err != nil {
+		return err
+	}
+	// The client is replaced when the session is resumed.
+	defer func() { client.Close() }()
+
+	offerSDP, err := peer.CreateOffer()
+	if err != nil {
+		return err
+	}
+	pubKey, err := identity.ExportPubKey()
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+
+	offer := signaling.Offer{
+		SessionId: sessionId,
+		OfferSDP:  offerSDP,
+		PubKey:    pubKey,
+		Timestamp: timestamp(),
+		TTL:       int(ttl.Seconds()),
+	}
+	if err := offer.Sign(identity.Signer()); err != nil {
+		return err
+	}
+	logFingerprint("Your key fingerprint:", offer.SigningKey)
+	resumeToken, err := client.CreateSession(waitCtx, offer)
+	if err != nil {
+		return fmt.Errorf("cannot create session: %w", err)
+	}
+	log.Println("Session id:", sessionId)
+	log.Println("Waiting for the receiver to join...")
+
+	connected := false
+	defer func() {
+		if !connected {
+			cancelSession(client, sessionId)
+		}
+	}()
+
+	for {
+		err := client.AwaitConfirmation(waitCtx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, signaling.ErrClosed) {
+			return err
+		}
+
+		log.Println("Signaling connection lost, resuming the session...")
+		client.Close()
+		resumed, token, err := resumeSignaling(waitCtx, opts, peer, sessionId, resumeToken)
+		if err != nil {
+			return fmt.Errorf("cannot resume session: %w", err)
+		}
+		client, resumeToken = resumed, token
+	}
+
+	pin, err := promptPIN()
+	if err != nil {
+		return err
+	}
+	answer, err := client.FetchAnswer(waitCtx, sessionId, pin)
+	if err != nil {
+		return fmt.Errorf("cannot fetch answer: %w", err)
+	}
+	if err := checkPeerSignature(answer.Verify(), answer.SigningKey); err != nil {
+		return err
+	}
+
+	if err := identity.DeriveSharedSecret(answer.PubKey); err != nil {
+		return err
+	}
+	if err := peer.AcceptAnswer(answer.AnswerSDP); err != nil {
+		return err
+	}
+	if err := peer.WaitOpen(waitCtx); err != nil {
+		return err
+	}
+	connected = true
+	log.Println("Connected to peer")
+
+	transfer := &Transfer{peer: peer, identity: identity}
+	for _, path := range flags.Args() {
+		if err := transfer.SendFile(ctx, path); err != nil {
+			return fmt.Errorf("cannot send %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func runReceive(ctx context.Context, args []string) error {
+	var opts options
+	var outDir string
+	flags := commonFlags("receive", &opts)
+	flags.StringVar(&outDir, "out", ".", "directory for received files")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	sessionId := flags.Arg(0)
+
+	identity, err := NewIdentity()
+	if err != nil {
+		return err
+	}
+	peer, err := NewPeer(false)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	client, err := dialSignaling(ctx, opts, peer)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	waitCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+
+	offer, err := client.FetchOffer(waitCtx, sessionId)
+	if err != nil {
+		return fmt.Errorf("cannot join session: %w", err)
+	}
+	if err := checkPeerSignature(offer.Verify(sessionId), offer.SigningKey); err != nil {
+		return err
+	}
+
+	if err := identity.DeriveSharedSecret(offer.PubKey); err != nil {
+		return err
+	}
+	answerSDP, err := peer.AcceptOffer(offer.OfferSDP)
+	if err != nil {
+		return err
+	}
+	pubKey, err := identity.ExportPubKey()
+	if err != nil {
+		return err
+	}
+
+	answer := signaling.Answer{
+		SessionId: sessionId,
+		AnswerSDP: answerSDP,
+		PubKey:    pubKey,
+		Timestamp: timestamp(),
+	}
+	if err := answer.Sign(identity.Signer()); err != nil {
+		return err
+	}
+	logFingerprint("Your key fingerprint:", answer.SigningKey)
+	pin, err := client.SendAnswer(waitCtx, answer)
+	if err != nil {
+		return fmt.Errorf("cannot answer session: %w", err)
+	}
+	log.Println("PIN:", pin)
+	log.Println("Share the PIN with the sender to accept the connection")
+
+	if err := peer.WaitOpen(waitCtx); err != nil {
+		cancelSession(client, sessionId)
+		return err
+	}
+	log.Println("Connected to peer")
+
+	transfer := &Transfer{peer: peer, identity: identity}
+	return transfer.ReceiveFiles(ctx, outDir)
+}
+
+// Connects to the signaling server, handing relayed candidates to the peer.
+func dialSignaling(ctx context.Context, opts options, peer *Peer) (*signaling.Client, error) {
+	addCandidate := func(candidate *signaling.ICECandidate) {
+		var init *webrtc.ICECandidateInit
+		if candidate != nil {
+			converted := webrtc.ICECandidateInit(*candidate)
+			init = &converted
+		}
+		if err := peer.AddRemoteCandidate(init); err != nil {
+			log.Println("Cannot add remote candidate:", err)
+		}
+	}
+	logEvent := func(msg signaling.Message) {
+		switch msg.Type {
+		case signaling.TypeAnswerRejected:
+			log.Println("Warning: another peer tried to join this session")
+		case signaling.TypeSessionExpiring:
+			var expiry signaling.SessionExpiry
+			json.Unmarshal(msg.Payload, &expiry)
+			log.Printf("Warning: the session expires at %s", expiry.ExpiresAt.Local().Format(time.TimeOnly))
+		}
+	}
+	client, err := signaling.Dial(ctx, opts.server,
+		signaling.WithOrigin(opts.origin),
+		signaling.WithCandidateHandler(addCandidate),
+		signaling.WithEventHandler(logEvent),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Hello(ctx, "hyperspace-cli"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Reconnects to the signaling server and takes over the session with the
+// resume token. Returns the new client and the token replacing the used one.
+func resumeSignaling(ctx context.Context, opts options, peer *Peer, sessionId, resumeToken string) (*signaling.Client, string, error) {
+	client, err := dialSignaling(ctx, opts, peer)
+	if err != nil {
+		return nil, "", err
+	}
+	resumed, err := client.Resume(ctx, sessionId, resumeToken)
+	if err != nil {
+		client.Close()
+		return nil, "", err
+	}
+	return client, resumed.ResumeToken, nil
+}
+
+// Tells the other peer that we gave up before the connection was made. The
+// session context may already be cancelled, so a fresh one is used.
+func cancelSession(client *signaling.Client, sessionId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client.CancelSession(ctx, sessionId)
+}
+
+func promptPIN() (string, error) {
+	fmt.Fprint(os.Stderr, "Enter the PIN shown by the receiver: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("cannot read PIN: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Same format as `new Date().toISOString()` in the browser.
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Fails when the peer signed its offer or answer with a bad signature. An
+// unsigned one is accepted with a warning since its keys cannot be checked.
+func checkPeerSignature(err error, signingKey string) error {
+	if errors.Is(err, signaling.ErrUnsigned) {
+		log.Println("Warning: the peer did not sign its keys, they cannot be verified")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot verify peer: %w", err)
+	}
+	logFingerprint("Peer key fingerprint:", signingKey)
+	return nil
+}
+
+// Logs the fingerprint of a signing key, both sides should see the same
+// ones when compared out of band.
+func logFingerprint(label string, signingKey string) {
+	if fingerprint, err := signaling.Fingerprint(signingKey); err == nil {
+		log.Println(label, fingerprint)
+	}
+}
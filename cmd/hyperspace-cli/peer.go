@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	DATA_CHANNEL_LABEL = "main"
+
+	// Same limits as `MAX_CHUNK_SIZE` in `web/static/ts/lib/constants.ts`.
+	MAX_CHUNK_SIZE     = 512 * 1024
+	DEFAULT_CHUNK_SIZE = 64 * 1024
+
+	CLOSE_FLUSH_TIMEOUT = 30 * time.Second
+)
+
+var iceServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302", "stun:stun1.l.google.com:19302"}},
+}
+
+// Peer wraps the WebRTC connection and the single data channel used for a
+// transfer. Data channel messages are exposed through `Incoming` so that
+// the transfer logic can process them in order.
+type Peer struct {
+	pc       *webrtc.PeerConnection
+	channel  *webrtc.DataChannel
+	incoming chan []byte
+	opened   chan struct{}
+	closed   chan struct{}
+
+	mutex      sync.Mutex
+	remoteSet  bool
+	candidates []webrtc.ICECandidateInit
+	closeOnce  sync.Once
+}
+
+func NewPeer(isOfferer bool) (*Peer, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: iceServers})
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &Peer{
+		pc:       pc,
+		incoming: make(chan []byte, 16),
+		opened:   make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			peer.markClosed()
+		}
+	})
+
+	if isOfferer {
+		channel, err := pc.CreateDataChannel(DATA_CHANNEL_LABEL, nil)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		peer.setChannel(channel)
+	} else {
+		pc.OnDataChannel(peer.setChannel)
+	}
+
+	return peer, nil
+}
+
+func (p *Peer) setChannel(channel *webrtc.DataChannel) {
+	p.channel = channel
+	channel.OnOpen(func() {
+		close(p.opened)
+	})
+	channel.OnClose(p.markClosed)
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		select {
+		case p.incoming <- msg.Data:
+		case <-p.closed:
+		}
+	})
+}
+
+func (p *Peer) markClosed() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// Creates the offer and returns it encoded like `encodeSDP` in the browser
+// client, once ICE gathering has completed.
+func (p *Peer) CreateOffer() (string, error) {
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+	return p.setLocalDescription(offer)
+}
+
+// Applies the remote offer and returns the encoded answer.
+func (p *Peer) AcceptOffer(encodedOffer string) (string, error) {
+	if err := p.setRemoteDescription(encodedOffer); err != nil {
+		return "", err
+	}
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	return p.setLocalDescription(answer)
+}
+
+func (p *Peer) AcceptAnswer(encodedAnswer string) error {
+	return p.setRemoteDescription(encodedAnswer)
+}
+
+// Adds a candidate trickled by the remote peer. Candidates received before
+// the remote description are queued until it is set. A nil candidate marks
+// the end of candidates and needs no action.
+func (p *Peer) AddRemoteCandidate(candidate *webrtc.ICECandidateInit) error {
+	if candidate == nil {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.remoteSet {
+		p.candidates = append(p.candidates, *candidate)
+		return nil
+	}
+	return p.pc.AddICECandidate(*candidate)
+}
+
+func (p *Peer) setLocalDescription(desc webrtc.SessionDescription) (string, error) {
+	gatheringDone := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		return "", err
+	}
+	<-gatheringDone
+
+	return encodeSDP(*p.pc.LocalDescription())
+}
+
+func (p *Peer) setRemoteDescription(encoded string) error {
+	desc, err := decodeSDP(encoded)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.pc.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	p.remoteSet = true
+
+	for _, candidate := range p.candidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	p.candidates = nil
+	return nil
+}
+
+// Blocks until the data channel is open.
+func (p *Peer) WaitOpen(ctx context.Context) error {
+	select {
+	case <-p.opened:
+		return nil
+	case <-p.closed:
+		return errors.New("peer connection closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the next message received on the data channel, or
+// `errPeerClosed` once the channel is gone.
+func (p *Peer) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-p.incoming:
+		return data, nil
+	case <-p.closed:
+		return nil, errPeerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Peer) Send(data []byte) error {
+	return p.channel.Send(data)
+}
+
+// Size of the file chunks, derived from the message size the remote SCTP
+// stack accepts with the same 2% margin the browser keeps for encryption.
+func (p *Peer) ChunkSize() int {
+	chunkSize := DEFAULT_CHUNK_SIZE
+	if maxSize := int(p.pc.SCTP().GetCapabilities().MaxMessageSize); maxSize > 0 {
+		chunkSize = min(MAX_CHUNK_SIZE, maxSize)
+	}
+	return chunkSize - (chunkSize*2+99)/100
+}
+
+// Waits for queued data channel messages to be handed to the network and
+// closes the connection.
+func (p *Peer) Close() error {
+	if p.channel != nil {
+		flushed := make(chan struct{})
+		p.channel.SetBufferedAmountLowThreshold(0)
+		p.channel.OnBufferedAmountLow(func() {
+			select {
+			case <-flushed:
+			default:
+				close(flushed)
+			}
+		})
+		if p.channel.BufferedAmount() > 0 {
+			select {
+			case <-flushed:
+			case <-p.closed:
+			case <-time.After(CLOSE_FLUSH_TIMEOUT):
+			}
+		}
+	}
+
+	p.markClosed()
+	return p.pc.Close()
+}
+
+func encodeSDP(desc webrtc.SessionDescription) (string, error) {
+	raw, err := json.Marshal(desc)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func decodeSDP(encoded string) (webrtc.SessionDescription, error) {
+	var desc webrtc.SessionDescription
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return desc, fmt.Errorf("invalid SDP encoding: %w", err)
+	}
+	if err := json.Unmarshal(raw, &desc); err != nil {
+		return desc, fmt.Errorf("invalid SDP: %w", err)
+	}
+	return desc, nil
+}
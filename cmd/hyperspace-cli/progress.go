@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Prints transfer progress on a single stderr line.
+type progress struct {
+	action  string
+	name    string
+	total   int64
+	percent int
+}
+
+func newProgress(action string, name string, total int64) *progress {
+	p := &progress{action: action, name: name, total: total, percent: -1}
+	p.Update(0)
+	return p
+}
+
+func (p *progress) Update(current int64) {
+	percent := 100
+	if p.total > 0 {
+		percent = int(current * 100 / p.total)
+	}
+	if percent == p.percent {
+		return
+	}
+
+	p.percent = percent
+	fmt.Fprintf(os.Stderr, "\r%s %s: %3d%%", p.action, p.name, percent)
+}
+
+func (p *progress) Done() {
+	fmt.Fprintln(os.Stderr)
+}
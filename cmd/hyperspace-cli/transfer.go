@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Data channel message types from `PeerMessageType` in
+// `web/static/ts/lib/constants.ts`.
+const (
+	InitMessage    = 0
+	PayloadMessage = 1
+	DoneMessage    = 2
+	CancelMessage  = 3
+	OkMessage      = 200
+	ErrorMessage   = 400
+)
+
+// A lone 0xff byte sent unencrypted cancels the running transfer.
+const CANCEL_SIGNAL = 0xff
+
+var (
+	errPeerClosed  = errors.New("peer disconnected")
+	errCancelled   = errors.New("transfer cancelled by peer")
+	errPeerFailure = errors.New("peer reported a transfer error")
+)
+
+type peerMessage struct {
+	Type int             `json:"type"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type initPayload struct {
+	FileName string `json:"fileName"`
+	FileType string `json:"fileType"`
+	FileSize int64  `json:"fileSize"`
+	Hash     string `json:"hash"`
+}
+
+// Transfer runs the file exchange protocol of `WebRTCPeer` over an open
+// data channel. Control messages and file chunks are encrypted with the
+// shared key, the end of file marker and the cancel signal are not.
+type Transfer struct {
+	peer     *Peer
+	identity *Identity
+}
+
+func (t *Transfer) sendMessage(msgType int, body any) error {
+	msg := peerMessage{Type: msgType}
+	if body != nil {
+		bodyRaw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = bodyRaw
+	}
+
+	msgRaw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	encrypted, err := t.identity.Encrypt(msgRaw)
+	if err != nil {
+		return err
+	}
+	return t.peer.Send(encrypted)
+}
+
+// Reads the next control message. Cancel signals surface as `errCancelled`.
+func (t *Transfer) nextMessage(ctx context.Context) (*peerMessage, error) {
+	data, err := t.peer.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if isCancelSignal(data) {
+		return nil, errCancelled
+	}
+
+	decrypted, err := t.identity.Decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt message: %w", err)
+	}
+
+	var msg peerMessage
+	if err := json.Unmarshal(decrypted, &msg); err != nil {
+		return nil, fmt.Errorf("invalid peer message: %w", err)
+	}
+	return &msg, nil
+}
+
+func (t *Transfer) awaitOk(ctx context.Context) error {
+	msg, err := t.nextMessage(ctx)
+	if err != nil {
+		return err
+	}
+	if msg.Type != OkMessage {
+		return errPeerFailure
+	}
+	return nil
+}
+
+// Sends a single file. Every step waits for the receiver's OK, which is how
+// the browser client paces the transfer.
+func (t *Transfer) SendFile(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	chunkSize := int64(t.peer.ChunkSize())
+	sizes := chunkSizes(info.Size(), chunkSize)
+	hash, err := buildHash(file, sizes)
+	if err != nil {
+		return err
+	}
+
+	metadata := initPayload{
+		FileName: filepath.Base(path),
+		FileType: mime.TypeByExtension(filepath.Ext(path)),
+		FileSize: info.Size(),
+		Hash:     hash,
+	}
+	if err := t.sendMessage(InitMessage, metadata); err != nil {
+		return err
+	}
+	if err := t.awaitOk(ctx); err != nil {
+		return err
+	}
+
+	progress := newProgress("Sending", metadata.FileName, metadata.FileSize)
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for _, size := range sizes {
+		if _, err := file.ReadAt(chunk[:size], offset); err != nil {
+			return err
+		}
+		encrypted, err := t.identity.Encrypt(chunk[:size])
+		if err != nil {
+			return err
+		}
+		if err := t.peer.Send(encrypted); err != nil {
+			return err
+		}
+		if err := t.awaitOk(ctx); err != nil {
+			return err
+		}
+
+		offset += size
+		progress.Update(offset)
+	}
+	progress.Done()
+
+	return t.peer.Send([]byte{})
+}
+
+// Receives files until the peer disconnects. A failed or cancelled file is
+// reported and removed without ending the session.
+func (t *Transfer) ReceiveFiles(ctx context.Context, outDir string) error {
+	for {
+		msg, err := t.nextMessage(ctx)
+		if errors.Is(err, errPeerClosed) {
+			return nil
+		}
+		if errors.Is(err, errCancelled) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Type != InitMessage {
+			continue
+		}
+
+		var metadata initPayload
+		if err := json.Unmarshal(msg.Body, &metadata); err != nil {
+			return fmt.Errorf("invalid transfer metadata: %w", err)
+		}
+
+		path, err := t.receiveFile(ctx, outDir, metadata)
+		if errors.Is(err, errPeerClosed) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Failed to receive %s: %v\n", metadata.FileName, err)
+			if !errors.Is(err, errCancelled) {
+				t.sendMessage(ErrorMessage, nil)
+			}
+			continue
+		}
+		log.Println("Saved", path)
+	}
+}
+
+func (t *Transfer) receiveFile(ctx context.Context, outDir string, metadata initPayload) (string, error) {
+	file, err := createOutputFile(outDir, metadata.FileName)
+	if err != nil {
+		return "", err
+	}
+
+	path := file.Name()
+	completed := false
+	defer func() {
+		file.Close()
+		if !completed {
+			os.Remove(path)
+		}
+	}()
+
+	if err := t.sendMessage(OkMessage, nil); err != nil {
+		return "", err
+	}
+
+	progress := newProgress("Receiving", metadata.FileName, metadata.FileSize)
+	var sizes []int64
+	var received int64
+	for {
+		data, err := t.peer.Next(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(data) == 0 {
+			break
+		}
+		if isCancelSignal(data) {
+			return "", errCancelled
+		}
+
+		chunk, err := t.identity.Decrypt(data)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt chunk: %w", err)
+		}
+		if _, err := file.Write(chunk); err != nil {
+			return "", err
+		}
+
+		sizes = append(sizes, int64(len(chunk)))
+		received += int64(len(chunk))
+		progress.Update(received)
+
+		if err := t.sendMessage(OkMessage, nil); err != nil {
+			return "", err
+		}
+	}
+	progress.Done()
+
+	if received != metadata.FileSize {
+		return "", fmt.Errorf("size mismatch, expected %d bytes and got %d", metadata.FileSize, received)
+	}
+	hash, err := buildHash(file, sizes)
+	if err != nil {
+		return "", err
+	}
+	if hash != metadata.Hash {
+		return "", errors.New("file integrity mismatch")
+	}
+
+	completed = true
+	return path, nil
+}
+
+// Creates the destination file without overwriting existing ones, adding a
+// numeric suffix when the name is taken.
+func createOutputFile(outDir string, fileName string) (*os.File, error) {
+	name := filepath.Base(filepath.Clean("/" + fileName))
+	if name == "/" || name == "." {
+		name = "download"
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+
+		file, err := os.OpenFile(filepath.Join(outDir, candidate), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return file, err
+	}
+}
+
+func isCancelSignal(data []byte) bool {
+	return len(data) == 1 && data[0] == CANCEL_SIGNAL
+}
+
+func chunkSizes(total int64, chunkSize int64) []int64 {
+	var sizes []int64
+	for offset := int64(0); offset < total; offset += chunkSize {
+		sizes = append(sizes, min(chunkSize, total-offset))
+	}
+	return sizes
+}
+
+// Port of `buildHash` in `web/static/ts/lib/utils.ts`. The chunks are
+// consumed in pairs from the front of a queue and the digest of each pair is
+// pushed to its back until a single element remains. Chunks are read from
+// `r` lazily so whole files never have to be held in memory.
+func buildHash(r io.ReaderAt, sizes []int64) (string, error) {
+	type node struct {
+		offset int64
+		size   int64
+		digest []byte
+	}
+
+	load := func(n node) ([]byte, error) {
+		if n.digest != nil {
+			return n.digest, nil
+		}
+		data := make([]byte, n.size)
+		_, err := r.ReadAt(data, n.offset)
+		return data, err
+	}
+
+	queue := make([]node, 0, len(sizes))
+	var offset int64
+	for _, size := range sizes {
+		queue = append(queue, node{offset: offset, size: size})
+		offset += size
+	}
+	if len(queue) == 0 {
+		return "", errors.New("cannot hash an empty file")
+	}
+
+	if len(queue) == 1 {
+		data, err := load(queue[0])
+		if err != nil {
+			return "", err
+		}
+		digest := sha256.Sum256(data)
+		return hex.EncodeToString(digest[:]), nil
+	}
+
+	for len(queue) > 1 {
+		first, err := load(queue[0])
+		if err != nil {
+			return "", err
+		}
+		second, err := load(queue[1])
+		if err != nil {
+			return "", err
+		}
+		queue = queue[2:]
+
+		hasher := sha256.New()
+		hasher.Write(first)
+		hasher.Write(second)
+		queue = append(queue, node{digest: hasher.Sum(nil)})
+	}
+
+	return hex.EncodeToString(queue[0].digest), nil
+}
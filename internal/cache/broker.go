@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const BROKER_BUFFER_SIZE = 256
+
+// How long a message received from redis waits for room in the buffer
+// before it is dropped.
+const BROKER_FULL_WAIT = 100 * time.Millisecond
+
+var ErrBrokerFull = errors.New("broker buffer is full")
+
+type BrokerMessage struct {
+	Channel string
+	Payload []byte
+}
+
+// Broker relays messages between server instances. Each instance subscribes
+// to the channels of the sessions it holds sockets for and receives every
+// message published on them, no matter which instance published it.
+//
+// Neither publishing nor receiving waits long for a slow consumer of
+// `Messages`. Once its buffer is full, messages are dropped, logged,
+// counted and reported to the `OnDrop` handler.
+type Broker interface {
+	Publish(channel string, payload []byte) error
+	Subscribe(channels ...string) error
+	Unsubscribe(channels ...string) error
+	Messages() <-chan BrokerMessage
+	// Number of messages dropped because the buffer was full.
+	Dropped() int64
+	// Registers the handler called with the channel of every dropped
+	// message.
+	OnDrop(handler func(channel string))
+	Close() error
+}
+
+// Counts, logs and reports the messages a broker drops.
+type dropCounter struct {
+	count   atomic.Int64
+	handler atomic.Pointer[func(channel string)]
+}
+
+func (d *dropCounter) drop(channel string) {
+	d.count.Add(1)
+	log.Println("ERROR: Broker buffer full, dropping message on", channel)
+	if handler := d.handler.Load(); handler != nil {
+		(*handler)(channel)
+	}
+}
+
+func (d *dropCounter) Dropped() int64 {
+	return d.count.Load()
+}
+
+func (d *dropCounter) OnDrop(handler func(channel string)) {
+	d.handler.Store(&handler)
+}
+
+// Returns a redis pub/sub broker when the store is backed by redis and an
+// in-process broker otherwise.
+func NewBroker(store Store) Broker {
+	if rdb, ok := store.(*Redis); ok {
+		return newRedisBroker(rdb.client)
+	}
+	return NewMemoryBroker()
+}
+
+type redisBroker struct {
+	dropCounter
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	messages chan BrokerMessage
+}
+
+func newRedisBroker(client *redis.Client) *redisBroker {
+	broker := &redisBroker{
+		client:   client,
+		pubsub:   client.Subscribe(),
+		messages: make(chan BrokerMessage, BROKER_BUFFER_SIZE),
+	}
+	go broker.receive()
+
+	return broker
+}
+
+func (b *redisBroker) receive() {
+	defer close(b.messages)
+
+	// Blocking for long here would stall the redis connection and with it
+	// every other subscription of the instance.
+	for msg := range b.pubsub.Channel() {
+		message := BrokerMessage{Channel: msg.Channel, Payload: []byte(msg.Payload)}
+		select {
+		case b.messages <- message:
+			continue
+		default:
+		}
+
+		select {
+		case b.messages <- message:
+		case <-time.After(BROKER_FULL_WAIT):
+			b.drop(msg.Channel)
+		}
+	}
+}
+
+func (b *redisBroker) Publish(channel string, payload []byte) error {
+	return b.client.Publish(channel, payload).Err()
+}
+
+func (b *redisBroker) Subscribe(channels ...string) error {
+	return b.pubsub.Subscribe(channels...)
+}
+
+func (b *redisBroker) Unsubscribe(channels ...string) error {
+	return b.pubsub.Unsubscribe(channels...)
+}
+
+func (b *redisBroker) Messages() <-chan BrokerMessage {
+	return b.messages
+}
+
+func (b *redisBroker) Close() error {
+	return b.pubsub.Close()
+}
+
+// MemoryBroker delivers published messages back to the same process. It is
+// used together with the memory store for single node deployments.
+//
+// Publishing never waits: the hub publishes from the goroutine that reads
+// `Messages` too.
+type MemoryBroker struct {
+	dropCounter
+	channels  map[string]struct{}
+	messages  chan BrokerMessage
+	mutex     sync.RWMutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		channels: make(map[string]struct{}),
+		messages: make(chan BrokerMessage, BROKER_BUFFER_SIZE),
+		done:     make(chan struct{}),
+	}
+}
+
+func (b *MemoryBroker) Publish(channel string, payload []byte) error {
+	b.mutex.RLock()
+	_, ok := b.channels[channel]
+	b.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+
+	select {
+	case b.messages <- BrokerMessage{Channel: channel, Payload: payload}:
+		return nil
+	default:
+		b.drop(channel)
+		return ErrBrokerFull
+	}
+}
+
+func (b *MemoryBroker) Subscribe(channels ...string) error {
+	b.mutex.Lock()
+	for _, channel := range channels {
+		b.channels[channel] = struct{}{}
+	}
+	b.mutex.Unlock()
+
+	return nil
+}
+
+func (b *MemoryBroker) Unsubscribe(channels ...string) error {
+	b.mutex.Lock()
+	for _, channel := range channels {
+		delete(b.channels, channel)
+	}
+	b.mutex.Unlock()
+
+	return nil
+}
+
+func (b *MemoryBroker) Messages() <-chan BrokerMessage {
+	return b.messages
+}
+
+func (b *MemoryBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
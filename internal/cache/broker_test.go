@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+
+	broker := NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+// Returns the next buffered message, if any, without blocking.
+func nextMessage(broker *MemoryBroker) (BrokerMessage, bool) {
+	select {
+	case msg := <-broker.Messages():
+		return msg, true
+	default:
+		return BrokerMessage{}, false
+	}
+}
+
+func TestMemoryBrokerDelivery(t *testing.T) {
+	tests := []struct {
+		name      string
+		subscribe []string
+		remove    []string
+		publish   string
+		delivered bool
+	}{
+		{"subscribed channel", []string{"a"}, nil, "a", true},
+		{"one of several channels", []string{"a", "b"}, nil, "b", true},
+		{"not subscribed", []string{"a"}, nil, "b", false},
+		{"unsubscribed", []string{"a"}, []string{"a"}, "a", false},
+		{"other channel unsubscribed", []string{"a", "b"}, []string{"b"}, "a", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t)
+			broker.Subscribe(tt.subscribe...)
+			broker.Unsubscribe(tt.remove...)
+
+			if err := broker.Publish(tt.publish, []byte("payload")); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+
+			msg, ok := nextMessage(broker)
+			if ok != tt.delivered {
+				t.Fatalf("delivered %v, want %v", ok, tt.delivered)
+			}
+			if ok && (msg.Channel != tt.publish || string(msg.Payload) != "payload") {
+				t.Fatalf("got %q on %s", msg.Payload, msg.Channel)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerFull(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.Subscribe("a")
+	var dropped []string
+	broker.OnDrop(func(channel string) { dropped = append(dropped, channel) })
+
+	for i := 0; i < BROKER_BUFFER_SIZE; i++ {
+		if err := broker.Publish("a", []byte("payload")); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if err := broker.Publish("a", []byte("payload")); !errors.Is(err, ErrBrokerFull) {
+		t.Fatalf("got %v, want ErrBrokerFull", err)
+	}
+	if count := broker.Dropped(); count != 1 {
+		t.Fatalf("dropped %d, want 1", count)
+	}
+	if len(dropped) != 1 || dropped[0] != "a" {
+		t.Fatalf("drop reported on %v, want [a]", dropped)
+	}
+
+	// Reading makes room again.
+	nextMessage(broker)
+	if err := broker.Publish("a", []byte("payload")); err != nil {
+		t.Fatalf("publish after read: %v", err)
+	}
+}
+
+func TestMemoryBrokerClosed(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.Subscribe("a")
+	broker.Close()
+
+	// Publishing after close neither blocks nor reports an error.
+	for i := 0; i <= BROKER_BUFFER_SIZE; i++ {
+		if err := broker.Publish("a", []byte("payload")); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if _, ok := nextMessage(broker); ok {
+		t.Fatal("message delivered after close")
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatalf("closing twice: %v", err)
+	}
+}
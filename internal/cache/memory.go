@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const MEMORY_CLEANUP_INTERVAL = time.Minute
+
+type memoryEntry struct {
+	value string
+	// Items of a list written with Push.
+	items     []string
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// Memory is an in-process Store meant for single node deployments and
+// tests. Expired entries are hidden on read and swept periodically.
+type Memory struct {
+	entries map[string]memoryEntry
+	mutex   sync.RWMutex
+	stop    chan struct{}
+	closed  sync.Once
+}
+
+func NewMemory() *Memory {
+	memory := &Memory{
+		entries: make(map[string]memoryEntry),
+		stop:    make(chan struct{}),
+	}
+	go memory.cleanupExpired()
+
+	return memory
+}
+
+func (m *Memory) Set(key string, value any, ttl int) error {
+	entry := memoryEntry{value: stringify(value)}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	m.mutex.Lock()
+	m.entries[key] = entry
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *Memory) Get(key string) (string, error) {
+	m.mutex.RLock()
+	entry, ok := m.entries[key]
+	m.mutex.RUnlock()
+
+	if !ok || entry.expired(time.Now()) {
+		return "", ErrKeyNotFound
+	}
+	return entry.value, nil
+}
+
+func (m *Memory) Del(key string) error {
+	m.mutex.Lock()
+	delete(m.entries, key)
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *Memory) GetDel(key string) (string, error) {
+	m.mutex.Lock()
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	m.mutex.Unlock()
+
+	if !ok || entry.expired(time.Now()) {
+		return "", ErrKeyNotFound
+	}
+	return entry.value, nil
+}
+
+func (m *Memory) SetNX(key string, value any, ttl int) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if entry, ok := m.entries[key]; ok && !entry.expired(now) {
+		return false, nil
+	}
+
+	entry := memoryEntry{value: stringify(value)}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	}
+	m.entries[key] = entry
+
+	return true, nil
+}
+
+func (m *Memory) Incr(key string, ttl int) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(now) {
+		entry = memoryEntry{value: "0"}
+		if ttl > 0 {
+			entry.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+		}
+	}
+
+	value, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value at %s is not an integer", key)
+	}
+	value++
+	entry.value = strconv.FormatInt(value, 10)
+	m.entries[key] = entry
+
+	return value, nil
+}
+
+func (m *Memory) CompareAndSwap(key string, old string, value any, ttl int) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(now) || entry.value != old {
+		return false, nil
+	}
+
+	entry = memoryEntry{value: stringify(value)}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	}
+	m.entries[key] = entry
+
+	return true, nil
+}
+
+func (m *Memory) CompareAndDelete(key string, old string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(time.Now()) || entry.value != old {
+		return false, nil
+	}
+	delete(m.entries, key)
+
+	return true, nil
+}
+
+func (m *Memory) Expire(key string, ttl int) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(now) {
+		return false, nil
+	}
+
+	entry.expiresAt = time.Time{}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	}
+	m.entries[key] = entry
+
+	return true, nil
+}
+
+func (m *Memory) Push(key string, value any, limit int, ttl int) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.entries[key]
+	if !ok || entry.expired(now) {
+		entry = memoryEntry{}
+	}
+	if len(entry.items) >= limit {
+		return 0, ErrListFull
+	}
+
+	entry.items = append(entry.items, stringify(value))
+	entry.expiresAt = time.Time{}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	}
+	m.entries[key] = entry
+
+	return int64(len(entry.items)), nil
+}
+
+func (m *Memory) Drain(key string) ([]string, error) {
+	m.mutex.Lock()
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	m.mutex.Unlock()
+
+	if !ok || entry.expired(time.Now()) {
+		return nil, nil
+	}
+	return entry.items, nil
+}
+
+// Stops the cleanup goroutine. Entries stay readable until their TTL.
+func (m *Memory) Close() error {
+	m.closed.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+func (m *Memory) cleanupExpired() {
+	ticker := time.NewTicker(MEMORY_CLEANUP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			m.mutex.Lock()
+			for key, entry := range m.entries {
+				if entry.expired(now) {
+					delete(m.entries, key)
+				}
+			}
+			m.mutex.Unlock()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Mirrors how the redis client serializes values so both backends read
+// back the same string.
+func stringify(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case json.RawMessage:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
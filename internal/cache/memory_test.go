@@ -0,0 +1,432 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMemory(t *testing.T) *Memory {
+	t.Helper()
+
+	memory := NewMemory()
+	t.Cleanup(func() { memory.Close() })
+	return memory
+}
+
+// Moves the expiry of the key into the past instead of waiting for it.
+func expire(m *Memory, key string) {
+	m.mutex.Lock()
+	entry := m.entries[key]
+	entry.expiresAt = time.Now().Add(-time.Second)
+	m.entries[key] = entry
+	m.mutex.Unlock()
+}
+
+func TestMemorySetGet(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"string", "value", "value"},
+		{"bytes", []byte("bytes"), "bytes"},
+		{"raw json", json.RawMessage(`{"a":1}`), `{"a":1}`},
+		{"integer", 42, "42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			if err := m.Set("key", tt.value, 60); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			got, err := m.Get("key")
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryMissingKey(t *testing.T) {
+	m := newTestMemory(t)
+
+	if _, err := m.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err := m.GetDel("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("getdel: got %v, want ErrKeyNotFound", err)
+	}
+	if err := m.Del("missing"); err != nil {
+		t.Fatalf("del: %v", err)
+	}
+}
+
+func TestMemoryTTLExpiry(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(t *testing.T, m *Memory)
+	}{
+		{"get", func(t *testing.T, m *Memory) {
+			if _, err := m.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("got %v, want ErrKeyNotFound", err)
+			}
+		}},
+		{"getdel", func(t *testing.T, m *Memory) {
+			if _, err := m.GetDel("key"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("got %v, want ErrKeyNotFound", err)
+			}
+		}},
+		{"setnx takes the key", func(t *testing.T, m *Memory) {
+			if stored, _ := m.SetNX("key", "new", 60); !stored {
+				t.Fatal("expired key not replaced")
+			}
+		}},
+		{"incr starts over", func(t *testing.T, m *Memory) {
+			if value, _ := m.Incr("key", 60); value != 1 {
+				t.Fatalf("got %d, want 1", value)
+			}
+		}},
+		{"compare and swap fails", func(t *testing.T, m *Memory) {
+			if swapped, _ := m.CompareAndSwap("key", "5", "6", 60); swapped {
+				t.Fatal("expired key swapped")
+			}
+		}},
+		{"compare and delete fails", func(t *testing.T, m *Memory) {
+			if deleted, _ := m.CompareAndDelete("key", "5"); deleted {
+				t.Fatal("expired key deleted")
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			m.Set("key", "5", 60)
+			expire(m, "key")
+			tt.check(t, m)
+		})
+	}
+}
+
+func TestMemoryZeroTTLNeverExpires(t *testing.T) {
+	m := newTestMemory(t)
+	m.Set("key", "value", 0)
+
+	if !m.entries["key"].expiresAt.IsZero() {
+		t.Fatal("key without TTL got an expiry")
+	}
+}
+
+func TestMemorySetNX(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   bool
+		expired    bool
+		wantStored bool
+		wantValue  string
+	}{
+		{"missing key", false, false, true, "new"},
+		{"existing key", true, false, false, "old"},
+		{"expired key", true, true, true, "new"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			if tt.existing {
+				m.Set("key", "old", 60)
+			}
+			if tt.expired {
+				expire(m, "key")
+			}
+
+			stored, err := m.SetNX("key", "new", 60)
+			if err != nil {
+				t.Fatalf("setnx: %v", err)
+			}
+			if stored != tt.wantStored {
+				t.Fatalf("stored %v, want %v", stored, tt.wantStored)
+			}
+			if value, _ := m.Get("key"); value != tt.wantValue {
+				t.Fatalf("value %q, want %q", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestMemoryIncr(t *testing.T) {
+	m := newTestMemory(t)
+
+	for want := int64(1); want <= 3; want++ {
+		value, err := m.Incr("counter", 60)
+		if err != nil {
+			t.Fatalf("incr: %v", err)
+		}
+		if value != want {
+			t.Fatalf("got %d, want %d", value, want)
+		}
+	}
+}
+
+// The TTL is set by the first increment and not pushed back by later ones.
+func TestMemoryIncrKeepsTTL(t *testing.T) {
+	m := newTestMemory(t)
+	m.Incr("counter", 60)
+	first := m.entries["counter"].expiresAt
+
+	m.Incr("counter", 600)
+	if got := m.entries["counter"].expiresAt; !got.Equal(first) {
+		t.Fatalf("expiry moved from %v to %v", first, got)
+	}
+}
+
+func TestMemoryIncrNonInteger(t *testing.T) {
+	m := newTestMemory(t)
+	m.Set("key", "not a number", 60)
+
+	if _, err := m.Incr("key", 60); err == nil {
+		t.Fatal("incremented a non integer value")
+	}
+	if value, _ := m.Get("key"); value != "not a number" {
+		t.Fatalf("value changed to %q", value)
+	}
+}
+
+func TestMemoryGetDel(t *testing.T) {
+	m := newTestMemory(t)
+	m.Set("key", "value", 60)
+
+	value, err := m.GetDel("key")
+	if err != nil || value != "value" {
+		t.Fatalf("got %q, %v", value, err)
+	}
+	if _, err := m.GetDel("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("second getdel: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestMemoryCompareAndSwap(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    bool
+		old         string
+		wantSwapped bool
+		wantValue   string
+	}{
+		{"matching value", true, "old", true, "new"},
+		{"changed value", true, "other", false, "old"},
+		{"missing key", false, "", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			if tt.existing {
+				m.Set("key", "old", 60)
+			}
+
+			swapped, err := m.CompareAndSwap("key", tt.old, "new", 60)
+			if err != nil {
+				t.Fatalf("compare and swap: %v", err)
+			}
+			if swapped != tt.wantSwapped {
+				t.Fatalf("swapped %v, want %v", swapped, tt.wantSwapped)
+			}
+			if value, _ := m.Get("key"); value != tt.wantValue {
+				t.Fatalf("value %q, want %q", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestMemoryCompareAndDelete(t *testing.T) {
+	tests := []struct {
+		name        string
+		old         string
+		wantDeleted bool
+	}{
+		{"matching value", "token", true},
+		{"other value", "other", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			m.Set("key", "token", 60)
+
+			deleted, err := m.CompareAndDelete("key", tt.old)
+			if err != nil {
+				t.Fatalf("compare and delete: %v", err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Fatalf("deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+			_, err = m.Get("key")
+			if gone := errors.Is(err, ErrKeyNotFound); gone != tt.wantDeleted {
+				t.Fatalf("key gone %v, want %v", gone, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestMemoryCleanupRemovesExpired(t *testing.T) {
+	m := newTestMemory(t)
+	m.Set("expired", "value", 60)
+	m.Set("alive", "value", 60)
+	expire(m, "expired")
+
+	// Mirrors one tick of `cleanupExpired`.
+	now := time.Now()
+	m.mutex.Lock()
+	for key, entry := range m.entries {
+		if entry.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+	m.mutex.Unlock()
+
+	if _, ok := m.entries["expired"]; ok {
+		t.Fatal("expired entry kept")
+	}
+	if _, ok := m.entries["alive"]; !ok {
+		t.Fatal("live entry removed")
+	}
+}
+
+func TestMemoryPushDrain(t *testing.T) {
+	tests := []struct {
+		name       string
+		pushes     int
+		limit      int
+		wantLength int
+		wantErr    error
+	}{
+		{"below the limit", 2, 3, 2, nil},
+		{"up to the limit", 3, 3, 3, nil},
+		{"past the limit", 4, 3, 3, ErrListFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+
+			var err error
+			for i := 0; i < tt.pushes; i++ {
+				_, err = m.Push("list", strconv.Itoa(i), tt.limit, 60)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("last push: got %v, want %v", err, tt.wantErr)
+			}
+
+			items, err := m.Drain("list")
+			if err != nil {
+				t.Fatalf("drain: %v", err)
+			}
+			if len(items) != tt.wantLength {
+				t.Fatalf("drained %d items, want %d", len(items), tt.wantLength)
+			}
+			for i, item := range items {
+				if item != strconv.Itoa(i) {
+					t.Fatalf("item %d is %q", i, item)
+				}
+			}
+
+			// Draining empties the list and frees room for new items.
+			if items, _ := m.Drain("list"); len(items) != 0 {
+				t.Fatalf("second drain returned %d items", len(items))
+			}
+			if length, err := m.Push("list", "new", tt.limit, 60); err != nil || length != 1 {
+				t.Fatalf("push after drain: %d, %v", length, err)
+			}
+		})
+	}
+}
+
+func TestMemoryPushExpired(t *testing.T) {
+	m := newTestMemory(t)
+	m.Push("list", "old", 1, 60)
+	expire(m, "list")
+
+	if items, _ := m.Drain("list"); len(items) != 0 {
+		t.Fatalf("drained %d expired items", len(items))
+	}
+	m.Push("list", "old", 1, 60)
+	expire(m, "list")
+	if _, err := m.Push("list", "new", 1, 60); err != nil {
+		t.Fatalf("push over an expired list: %v", err)
+	}
+}
+
+func TestMemoryPushConcurrent(t *testing.T) {
+	const pushes = 50
+	m := newTestMemory(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Push("list", strconv.Itoa(i), pushes, 60)
+		}()
+	}
+	wg.Wait()
+
+	if items, _ := m.Drain("list"); len(items) != pushes {
+		t.Fatalf("drained %d items, want %d", len(items), pushes)
+	}
+}
+
+func TestMemoryExpire(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   bool
+		expired    bool
+		wantExists bool
+	}{
+		{"existing key", true, false, true},
+		{"missing key", false, false, false},
+		{"expired key", true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			if tt.existing {
+				m.Set("key", "value", 60)
+			}
+			if tt.expired {
+				expire(m, "key")
+			}
+
+			exists, err := m.Expire("key", 600)
+			if err != nil {
+				t.Fatalf("expire: %v", err)
+			}
+			if exists != tt.wantExists {
+				t.Fatalf("exists %v, want %v", exists, tt.wantExists)
+			}
+
+			value, err := m.Get("key")
+			if !tt.wantExists {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("missing key created: %q", value)
+				}
+				return
+			}
+			if value != "value" {
+				t.Fatalf("value changed to %q", value)
+			}
+			if remaining := time.Until(m.entries["key"].expiresAt); remaining < 590*time.Second {
+				t.Fatalf("TTL not renewed, %v left", remaining)
+			}
+		})
+	}
+}
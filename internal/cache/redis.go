@@ -3,6 +3,8 @@ package cache
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
@@ -11,49 +13,116 @@ import (
 	utils "github.com/vladNed/hyperspace/internal/utils"
 )
 
+// Sets KEYS[1] to ARGV[2] with a TTL of ARGV[3] seconds when it holds
+// ARGV[1]. Runs atomically on the server.
+var compareAndSwapScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// Deletes KEYS[1] when it holds ARGV[1].
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// Appends ARGV[1] to the list at KEYS[1] unless it holds ARGV[2] items
+// already, then renews its TTL to ARGV[3] seconds. Returns -1 when full.
+var pushScript = redis.NewScript(`
+if redis.call("LLEN", KEYS[1]) >= tonumber(ARGV[2]) then
+	return -1
+end
+local length = redis.call("RPUSH", KEYS[1], ARGV[1])
+if tonumber(ARGV[3]) > 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+end
+return length
+`)
+
+// Increments KEYS[1] and gives it a TTL of ARGV[1] seconds when it was
+// just created, so a counter never outlives its TTL.
+var incrScript = redis.NewScript(`
+local value = redis.call("INCR", KEYS[1])
+if value == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return value
+`)
+
 type Redis struct {
 	client *redis.Client
 }
 
-func NewRedis() *Redis {
-	config := settings.GetInstance()
+// Creates the redis client shared by the whole process. Certificates are
+// read once here and the underlying client keeps its own connection pool,
+// so callers should create a single instance at startup and pass it around.
+func NewRedis(config *settings.Settings) (*Redis, error) {
+	options := &redis.Options{
+		Addr: config.RedisAddr + ":" + config.RedisPort,
+	}
 
-	// Load CA cert
-	caCert, err := os.ReadFile("./certs/ca.crt")
-	if err != nil {
-		panic(err)
+	if config.RedisTLS {
+		tlsConfig, err := newRedisTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
 	}
 
-	certPool := x509.NewCertPool()
-	if ok := certPool.AppendCertsFromPEM(caCert); !ok {
-		panic("Failed to append CA cert")
+	client := redis.NewClient(options)
+	if _, err := client.Ping().Result(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot reach redis: %w", err)
 	}
 
-	clientCert, err := tls.LoadX509KeyPair("./certs/client.crt", "./certs/client.key")
-	if err != nil {
-		panic(err)
+	return &Redis{
+		client: client,
+	}, nil
+}
+
+// Builds a mutual TLS config from the paths in settings. When no CA is set
+// the system roots are used to verify the server.
+func newRedisTLSConfig(config *settings.Settings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.RedisServerName,
 	}
 
-	// TODO: Read certificates once adn store in settings or in memory somewhere
-	client := redis.NewClient(&redis.Options{
-		Addr: config.RedisAddr + ":" + config.RedisPort,
-		TLSConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS12,
-			RootCAs:            certPool,
-			ClientCAs:          certPool,
-			Certificates:       []tls.Certificate{clientCert},
-		},
-	})
-
-	_, err = client.Ping().Result()
-	if err != nil {
-		panic(err)
+	if config.RedisCACert != "" {
+		caCert, err := os.ReadFile(config.RedisCACert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA cert: %w", err)
+		}
+
+		certPool := x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM(caCert); !ok {
+			return nil, errors.New("failed to append CA cert")
+		}
+		tlsConfig.RootCAs = certPool
 	}
 
-	return &Redis{
-		client: client,
+	if config.RedisClientCert != "" || config.RedisClientKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.RedisClientCert, config.RedisClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
 	}
+
+	return tlsConfig, nil
+}
+
+func (rdb *Redis) Close() error {
+	return rdb.client.Close()
 }
 
 func (rdb *Redis) Set(key string, value any, ttl int) error {
@@ -63,10 +132,94 @@ func (rdb *Redis) Set(key string, value any, ttl int) error {
 
 func (rdb *Redis) Get(key string) (string, error) {
 	keyHash := utils.HashSessionId(key)
-	return rdb.client.Get(keyHash).Result()
+	value, err := rdb.client.Get(keyHash).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
 }
 
 func (rdb *Redis) Del(key string) error {
 	keyHash := utils.HashSessionId(key)
 	return rdb.client.Del(keyHash).Err()
 }
+
+func (rdb *Redis) GetDel(key string) (string, error) {
+	keyHash := utils.HashSessionId(key)
+	pipe := rdb.client.TxPipeline()
+	get := pipe.Get(keyHash)
+	pipe.Del(keyHash)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	value, err := get.Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (rdb *Redis) SetNX(key string, value any, ttl int) (bool, error) {
+	keyHash := utils.HashSessionId(key)
+	return rdb.client.SetNX(keyHash, value, time.Duration(ttl)*time.Second).Result()
+}
+
+func (rdb *Redis) Incr(key string, ttl int) (int64, error) {
+	keyHash := utils.HashSessionId(key)
+	return incrScript.Run(rdb.client, []string{keyHash}, ttl).Int64()
+}
+
+func (rdb *Redis) CompareAndSwap(key string, old string, value any, ttl int) (bool, error) {
+	keyHash := utils.HashSessionId(key)
+	swapped, err := compareAndSwapScript.Run(rdb.client, []string{keyHash}, old, value, ttl).Int()
+	if err != nil {
+		return false, err
+	}
+	return swapped == 1, nil
+}
+
+func (rdb *Redis) CompareAndDelete(key string, old string) (bool, error) {
+	keyHash := utils.HashSessionId(key)
+	deleted, err := compareAndDeleteScript.Run(rdb.client, []string{keyHash}, old).Int()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
+
+func (rdb *Redis) Expire(key string, ttl int) (bool, error) {
+	keyHash := utils.HashSessionId(key)
+	// EXPIRE with a zero TTL would delete the key.
+	if ttl <= 0 {
+		if err := rdb.client.Persist(keyHash).Err(); err != nil {
+			return false, err
+		}
+		exists, err := rdb.client.Exists(keyHash).Result()
+		return exists == 1, err
+	}
+	return rdb.client.Expire(keyHash, time.Duration(ttl)*time.Second).Result()
+}
+
+func (rdb *Redis) Push(key string, value any, limit int, ttl int) (int64, error) {
+	keyHash := utils.HashSessionId(key)
+	length, err := pushScript.Run(rdb.client, []string{keyHash}, value, limit, ttl).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return 0, ErrListFull
+	}
+	return length, nil
+}
+
+func (rdb *Redis) Drain(key string) ([]string, error) {
+	keyHash := utils.HashSessionId(key)
+	pipe := rdb.client.TxPipeline()
+	items := pipe.LRange(keyHash, 0, -1)
+	pipe.Del(keyHash)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	return items.Val(), nil
+}
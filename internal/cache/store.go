@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vladNed/hyperspace/internal/settings"
+)
+
+const (
+	RedisBackend  = "redis"
+	MemoryBackend = "memory"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrListFull    = errors.New("list is full")
+)
+
+// Store is the session storage used by the server and the hub. Values are
+// always read back as strings and every write carries a TTL in seconds.
+type Store interface {
+	Get(key string) (string, error)
+	Set(key string, value any, ttl int) error
+	Del(key string) error
+	// Reads and deletes the key in one step, so only one caller gets the
+	// value.
+	GetDel(key string) (string, error)
+	// Stores the value only if the key does not exist yet. Reports whether
+	// the value was stored.
+	SetNX(key string, value any, ttl int) (bool, error)
+	// Increments the integer stored at key and returns the new value. The
+	// TTL only applies when the key is created, so counters expire a fixed
+	// time after their first increment.
+	Incr(key string, ttl int) (int64, error)
+	// Replaces the value only if the key still holds `old`. Reports whether
+	// the value was replaced, a missing key is never replaced.
+	CompareAndSwap(key string, old string, value any, ttl int) (bool, error)
+	// Deletes the key only if it still holds `old`. Reports whether the key
+	// was deleted.
+	CompareAndDelete(key string, old string) (bool, error)
+	// Sets a new TTL on an existing key without touching its value. Reports
+	// whether the key exists, a missing key is never created.
+	Expire(key string, ttl int) (bool, error)
+	// Appends the value to the list at key and returns its new length. Fails
+	// with ErrListFull when the list already holds `limit` items. The TTL is
+	// renewed on every push.
+	Push(key string, value any, limit int, ttl int) (int64, error)
+	// Removes and returns every item of the list at key in one step, so each
+	// item goes to a single caller. A missing key is an empty list.
+	Drain(key string) ([]string, error)
+	Close() error
+}
+
+// Creates the store configured through `settings.CacheBackend`. It is meant
+// to be called once at startup and shared by every consumer.
+func NewStore(config *settings.Settings) (Store, error) {
+	switch config.CacheBackend {
+	case RedisBackend:
+		redis, err := NewRedis(config)
+		if err != nil {
+			return nil, err
+		}
+		return redis, nil
+	case MemoryBackend:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", config.CacheBackend)
+	}
+}
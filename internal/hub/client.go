@@ -0,0 +1,239 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vladNed/hyperspace/internal/settings"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+// What a client does with a message while its send queue is full, see
+// `settings.WSSlowConsumerPolicy`.
+const (
+	PolicyDrop       = "drop"
+	PolicyDisconnect = "disconnect"
+)
+
+// Slots of the send queue held back for replies to requests, on top of
+// `settings.WSSendQueueSize`, so pushed messages never crowd them out.
+const REPLY_QUEUE_RESERVE = 8
+
+var (
+	ErrClientClosed = errors.New("client is closed")
+	ErrQueueFull    = errors.New("client send queue is full")
+	ErrSlowConsumer = errors.New("client disconnected for not keeping up")
+)
+
+// Client owns a single websocket connection. Every write to the connection
+// goes through the send queue and is performed by the client's own writer
+// goroutine, since gorilla/websocket allows only one concurrent writer.
+type Client struct {
+	id           string
+	conn         *websocket.Conn
+	send         chan []byte
+	queueSize    int
+	done         chan struct{}
+	finished     chan struct{}
+	released     chan struct{}
+	closeOnce    sync.Once
+	closeCode    int
+	closeReason  string
+	pingInterval time.Duration
+	pongWait     time.Duration
+	writeWait    time.Duration
+	policy       string
+	counters     *counters
+	version      int
+	features     []string
+}
+
+func newClient(conn *websocket.Conn, config *settings.Settings, counters *counters) *Client {
+	client := &Client{
+		id:           utils.GetRandomId(),
+		conn:         conn,
+		send:         make(chan []byte, config.WSSendQueueSize+REPLY_QUEUE_RESERVE),
+		queueSize:    config.WSSendQueueSize,
+		done:         make(chan struct{}),
+		finished:     make(chan struct{}),
+		released:     make(chan struct{}),
+		closeCode:    websocket.CloseNormalClosure,
+		pingInterval: config.WSPingInterval,
+		pongWait:     config.WSPongWait,
+		writeWait:    config.WSWriteWait,
+		policy:       config.WSSlowConsumerPolicy,
+		counters:     counters,
+	}
+
+	// Every pong pushes the read deadline further, so a reader blocked on a
+	// half-open connection fails once the peer stops answering pings.
+	conn.SetReadLimit(int64(config.WSMaxMessageSize))
+	conn.SetReadDeadline(time.Now().Add(client.pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(client.pongWait))
+	})
+
+	return client
+}
+
+// Unique id of the connection, used to tie session roles to it in the
+// shared store.
+func (c *Client) Id() string {
+	return c.id
+}
+
+// Protocol version negotiated with `hello`, zero until then. Only the
+// reader of the connection uses it, like the features.
+func (c *Client) ProtocolVersion() int {
+	return c.version
+}
+
+// Records the outcome of `hello`.
+func (c *Client) SetProtocol(version int, features []string) {
+	c.version = version
+	c.features = features
+}
+
+// Reports whether the optional part of the protocol was negotiated.
+func (c *Client) HasFeature(feature string) bool {
+	return slices.Contains(c.features, feature)
+}
+
+func (c *Client) Conn() *websocket.Conn {
+	return c.conn
+}
+
+// Queues a raw message for the writer goroutine without blocking, so a
+// stalled peer never holds up the hub. When the queue is full the message
+// is dropped and, with the disconnect policy, the client is closed.
+func (c *Client) Send(message []byte) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	if len(c.send) < c.queueSize {
+		select {
+		case c.send <- message:
+			return nil
+		default:
+		}
+	}
+
+	c.counters.dropped.Add(1)
+	if c.policy == PolicyDrop {
+		log.Println("Dropping message for slow client:", c.id)
+		return ErrQueueFull
+	}
+	c.disconnectSlow()
+	return ErrSlowConsumer
+}
+
+// Queues the reply to a request. Replies may use the reserved slots and are
+// never dropped, a client that does not read them is disconnected whatever
+// the policy.
+func (c *Client) Reply(value any) error {
+	message, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	case c.send <- message:
+		return nil
+	default:
+	}
+
+	c.disconnectSlow()
+	return ErrSlowConsumer
+}
+
+func (c *Client) disconnectSlow() {
+	c.counters.disconnected.Add(1)
+	log.Println("Disconnecting slow client:", c.id)
+	c.CloseWithReason(websocket.CloseTryAgainLater, "too slow")
+}
+
+// Stops the writer goroutine which then closes the underlying connection.
+func (c *Client) Close() {
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// Like `Close` but the peer receives the given close code and reason once
+// the messages already queued have been written.
+func (c *Client) CloseWithReason(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// Closed once the writer goroutine has exited and the connection is closed.
+func (c *Client) Finished() <-chan struct{} {
+	return c.finished
+}
+
+// Closed once the client was unregistered, after its reader returned and
+// the sessions it took part in were handled.
+func (c *Client) Released() <-chan struct{} {
+	return c.released
+}
+
+// Writes queued messages and pings the peer every `pingInterval`. Closing
+// the connection on exit also unblocks the reader.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		close(c.finished)
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Println("Error writing message:", err)
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("Error sending ping:", err)
+				c.Close()
+				return
+			}
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+			c.drain()
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+			return
+		}
+	}
+}
+
+// Flushes whatever is still queued so the peer does not miss messages sent
+// right before the client was closed.
+func (c *Client) drain() {
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
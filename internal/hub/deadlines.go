@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"time"
+)
+
+const DEADLINE_CHECK_INTERVAL = time.Second
+
+type deadline struct {
+	expiresAt time.Time
+	warned    bool
+}
+
+// Registers the handlers called by `Run` when a tracked session gets close
+// to its deadline and once it passed it.
+func (h *Hub) OnExpiry(expiring func(sessionId string, expiresAt time.Time), expired func(sessionId string)) {
+	h.onExpiring = expiring
+	h.onExpired = expired
+}
+
+// Sets the deadline of a session with a local client. A later deadline
+// re-arms the expiry warning.
+func (h *Hub) TrackSession(sessionId string, expiresAt time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.connections[sessionId]; !ok {
+		return
+	}
+	h.deadlines[sessionId] = &deadline{expiresAt: expiresAt}
+}
+
+// Sends a message to every local client of the session. With `detach` the
+// clients are removed from the session afterwards.
+func (h *Hub) SendLocal(sessionId string, message []byte, detach bool) {
+	for _, client := range h.localClients(sessionId, "") {
+		client.Send(message)
+		if detach {
+			h.LeaveSession(client, sessionId)
+		}
+	}
+}
+
+// Warns once per deadline when a session enters its last
+// `settings.SessionExpiryWarning` and reports it as expired once the
+// deadline passed. Expired sessions are no longer tracked.
+func (h *Hub) checkDeadlines(now time.Time) {
+	var expiring, expired []string
+	expiresAt := make(map[string]time.Time)
+
+	h.mutex.Lock()
+	for sessionId, entry := range h.deadlines {
+		switch {
+		case !now.Before(entry.expiresAt):
+			expired = append(expired, sessionId)
+			delete(h.deadlines, sessionId)
+		case !entry.warned && !now.Before(entry.expiresAt.Add(-h.config.SessionExpiryWarning)):
+			entry.warned = true
+			expiring = append(expiring, sessionId)
+			expiresAt[sessionId] = entry.expiresAt
+		}
+	}
+	h.mutex.Unlock()
+
+	if h.onExpiring != nil {
+		for _, sessionId := range expiring {
+			h.onExpiring(sessionId, expiresAt[sessionId])
+		}
+	}
+	if h.onExpired != nil {
+		for _, sessionId := range expired {
+			h.onExpired(sessionId)
+		}
+	}
+}
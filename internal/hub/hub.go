@@ -2,92 +2,416 @@ package hub
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	"github.com/vladNed/hyperspace/internal/utils"
 )
 
-var hub *Hub
+const SESSION_CHANNEL_PREFIX = "hyperspace:session:"
 
+// Role of a connection within a session.
+type Role string
+
+const (
+	Offerer  Role = "offerer"
+	Answerer Role = "answerer"
+)
+
+const (
+	RECEIVER_ROLE_PREFIX = "receiver-"
+	MEMBER_ROLE_PREFIX   = "member-"
+)
+
+// Role of one of the answerers of a broadcast session.
+func ReceiverRole(receiverId string) Role {
+	return Role(RECEIVER_ROLE_PREFIX + receiverId)
+}
+
+// Returns the receiver id of a role created by `ReceiverRole`.
+func (r Role) ReceiverId() (string, bool) {
+	return strings.CutPrefix(string(r), RECEIVER_ROLE_PREFIX)
+}
+
+// Role of a member of a room.
+func MemberRole(memberId string) Role {
+	return Role(MEMBER_ROLE_PREFIX + memberId)
+}
+
+// Returns the member id of a role created by `MemberRole`.
+func (r Role) MemberId() (string, bool) {
+	return strings.CutPrefix(string(r), MEMBER_ROLE_PREFIX)
+}
+
+// Hub keeps track of which local client holds which role in which session.
+// Both directions are indexed, so addressing a peer and dropping a client
+// cost the same no matter how many sockets are open.
 type Hub struct {
-	connections map[string]*websocket.Conn
-	broadcast   chan BroadcastPayload
-	ctx         context.Context
-	cache       *cache.Redis
+	// Session id to the clients holding its roles.
+	connections map[string]map[Role]*Client
+	// Registered client to the sessions it takes part in, with its role.
+	clients map[*Client]map[string]Role
+	// Broker channel to the session it carries, for the sessions above.
+	channels map[string]string
+	mutex    sync.RWMutex
+	// Serializes broker subscriptions, see `unsubscribe`.
+	subscriptions sync.Mutex
+	broker        cache.Broker
+	ctx           context.Context
+	cancel        context.CancelFunc
+	config        *settings.Settings
+	onLeave       func(client *Client, sessionId string, role Role)
+	counters      counters
+
+	// Expiry of the sessions with a local client, see deadlines.go.
+	deadlines  map[string]*deadline
+	onExpiring func(sessionId string, expiresAt time.Time)
+	onExpired  func(sessionId string)
 }
 
-func NewHub() *Hub {
-	ctx := context.Background()
-	return &Hub{
-		connections: make(map[string]*websocket.Conn),
-		broadcast:   make(chan BroadcastPayload),
+func NewHub(config *settings.Settings, broker cache.Broker) *Hub {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &Hub{
+		connections: make(map[string]map[Role]*Client),
+		clients:     make(map[*Client]map[string]Role),
+		channels:    make(map[string]string),
+		deadlines:   make(map[string]*deadline),
+		broker:      broker,
 		ctx:         ctx,
-		cache:       cache.NewRedis(),
+		cancel:      cancel,
+		config:      config,
 	}
+	broker.OnDrop(h.disconnectDropped)
+	return h
 }
 
-func GetInstance() *Hub {
-	if hub == nil {
-		hub = NewHub()
+// Wraps a freshly upgraded connection in a client and starts its writer.
+// The caller remains the only reader of the connection.
+func (h *Hub) Register(conn *websocket.Conn) *Client {
+	client := newClient(conn, h.config, &h.counters)
+	go client.writePump()
+
+	h.mutex.Lock()
+	h.clients[client] = make(map[string]Role)
+	h.mutex.Unlock()
+
+	// Upgraded while shutting down, after `Shutdown` closed the others.
+	if h.Stopping() {
+		client.CloseWithReason(websocket.CloseServiceRestart, "server restarting")
 	}
+	return client
+}
+
+// Drops every session owned by the client and stops its writer. Called by
+// the reader of the connection once it returns.
+func (h *Hub) Unregister(client *Client) {
+	h.RemoveSession(client)
+	client.Close()
 
-	return hub
+	h.mutex.Lock()
+	delete(h.clients, client)
+	h.mutex.Unlock()
+	close(client.released)
 }
 
-func (h *Hub) AddSession(conn *websocket.Conn, sessionId string) {
-	h.connections[sessionId] = conn
+// Reports whether `Shutdown` was called. Connections dropping from then on
+// were closed by the server, their sessions should outlive them.
+func (h *Hub) Stopping() bool {
+	return h.ctx.Err() != nil
 }
 
-func (h *Hub) RemoveSession(conn *websocket.Conn) {
-	for key, value := range h.connections {
-		if value == conn {
-			delete(h.connections, key)
-			if err := h.cache.Del(key); err != nil {
-				log.Println("ERROR: Cannot delete cached sessions ->>", err)
+// Stops `Run` and closes every connection with a "server restarting" close
+// frame. Returns once all writers have flushed their queues and every
+// reader was unregistered, or when the context is done, whichever comes
+// first. The session store is no longer used by the hub afterwards.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.cancel()
+
+	h.mutex.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mutex.RUnlock()
+
+	for _, client := range clients {
+		client.CloseWithReason(websocket.CloseServiceRestart, "server restarting")
+	}
+
+	defer h.broker.Close()
+	for _, client := range clients {
+		for _, finished := range []<-chan struct{}{client.Finished(), client.Released()} {
+			select {
+			case <-finished:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			return
 		}
 	}
+	return nil
 }
 
-func (h *Hub) GetConnections() map[string]*websocket.Conn {
-	return h.connections
+// Makes the client the holder of the role in the session. A client that
+// held the role before, e.g. a peer that resumed from a new connection,
+// loses it.
+func (h *Hub) AddSession(client *Client, sessionId string, role Role) {
+	h.mutex.Lock()
+	peers, ok := h.connections[sessionId]
+	if !ok {
+		peers = make(map[Role]*Client)
+		h.connections[sessionId] = peers
+		h.channels[sessionChannel(sessionId)] = sessionId
+	}
+	if previous, held := peers[role]; held && previous != client {
+		delete(h.clients[previous], sessionId)
+	}
+	peers[role] = client
+
+	sessions, registered := h.clients[client]
+	if !registered {
+		sessions = make(map[string]Role)
+		h.clients[client] = sessions
+	}
+	sessions[sessionId] = role
+	h.mutex.Unlock()
+
+	if ok {
+		return
+	}
+	h.subscriptions.Lock()
+	defer h.subscriptions.Unlock()
+	if err := h.broker.Subscribe(sessionChannel(sessionId)); err != nil {
+		log.Println("ERROR: Cannot subscribe to session channel ->>", err)
+	}
+}
+
+// Registers the handler called for every session a client drops out of
+// when its connection goes away. It is not called for `LeaveSession`.
+func (h *Hub) OnLeave(handler func(client *Client, sessionId string, role Role)) {
+	h.onLeave = handler
 }
 
-func (h *Hub) GetConnBySessionId(sessionId string) *websocket.Conn {
-	value, ok := h.connections[sessionId]
+// Detaches the client from every session it takes part in, after its
+// connection dropped.
+func (h *Hub) RemoveSession(client *Client) {
+	type membership struct {
+		sessionId string
+		role      Role
+	}
+	var left []membership
+	var emptied []string
+
+	h.mutex.Lock()
+	for sessionId, role := range h.clients[client] {
+		delete(h.clients[client], sessionId)
+		if h.detach(client, sessionId, role) {
+			emptied = append(emptied, sessionId)
+		}
+		left = append(left, membership{sessionId, role})
+	}
+	h.mutex.Unlock()
+
+	h.unsubscribe(emptied...)
+	if h.onLeave == nil {
+		return
+	}
+	for _, entry := range left {
+		h.onLeave(client, entry.sessionId, entry.role)
+	}
+}
+
+// Detaches the client from a single session, e.g. once it was closed.
+func (h *Hub) LeaveSession(client *Client, sessionId string) {
+	var emptied []string
+
+	h.mutex.Lock()
+	if role, ok := h.clients[client][sessionId]; ok {
+		delete(h.clients[client], sessionId)
+		if h.detach(client, sessionId, role) {
+			emptied = append(emptied, sessionId)
+		}
+	}
+	h.mutex.Unlock()
+
+	h.unsubscribe(emptied...)
+}
+
+// Removes the client from the role it holds in the session and reports
+// whether the session has no local clients left. Must be called with the
+// mutex held.
+func (h *Hub) detach(client *Client, sessionId string, role Role) bool {
+	peers := h.connections[sessionId]
+	if peers[role] == client {
+		delete(peers, role)
+	}
+	if len(peers) > 0 {
+		return false
+	}
+	delete(h.connections, sessionId)
+	delete(h.channels, sessionChannel(sessionId))
+	delete(h.deadlines, sessionId)
+	return true
+}
+
+// Unsubscribes from the channels of sessions that lost their last local
+// client. A client may have joined one of them again since, so each is
+// checked once more while subscriptions are held off: either the join
+// happened before and the channel is kept, or its subscribe runs after.
+func (h *Hub) unsubscribe(sessionIds ...string) {
+	if len(sessionIds) == 0 {
+		return
+	}
+	h.subscriptions.Lock()
+	defer h.subscriptions.Unlock()
+
+	for _, sessionId := range sessionIds {
+		h.mutex.RLock()
+		_, active := h.connections[sessionId]
+		h.mutex.RUnlock()
+		if active {
+			continue
+		}
+		if err := h.broker.Unsubscribe(sessionChannel(sessionId)); err != nil {
+			log.Println("ERROR: Cannot unsubscribe from session channel ->>", err)
+		}
+	}
+}
+
+func (h *Hub) GetClient(sessionId string, role Role) *Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	value, ok := h.connections[sessionId][role]
 	if !ok {
 		return nil
 	}
 	return value
 }
 
-func (h *Hub) BroadcastMessage(payload BroadcastPayload) {
-	h.broadcast <- payload
+// Returns the role the client holds in the session on this instance.
+func (h *Hub) GetRole(client *Client, sessionId string) (Role, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	role, ok := h.clients[client][sessionId]
+	return role, ok
 }
 
-func (h *Hub) CheckConnHasActiveSession(conn *websocket.Conn) bool {
-	for _, value := range h.connections {
-		if value == conn {
-			return true
-		}
+// Publishes the message on the session channel so that the instance
+// holding the session socket can deliver it.
+func (h *Hub) BroadcastMessage(payload BroadcastPayload) error {
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
 	}
-	return false
+	return h.broker.Publish(sessionChannel(payload.SessionId), rawPayload)
+}
+
+func (h *Hub) CheckClientHasActiveSession(client *Client) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.clients[client]) > 0
 }
 
 func (h *Hub) Run() {
+	ticker := time.NewTicker(DEADLINE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case payload := <-h.broadcast:
-			for _, conn := range h.connections {
-				if payload.Conn == conn {
-					conn.WriteJSON(payload.Message)
-				}
+		case now := <-ticker.C:
+			h.checkDeadlines(now)
+		case message, ok := <-h.broker.Messages():
+			if !ok {
+				return
 			}
+			h.deliver(message)
 		case <-h.ctx.Done():
 			return
 		}
 	}
 }
+
+// Hands a broker message to the local client holding the target role of
+// its session, if any.
+func (h *Hub) deliver(message cache.BrokerMessage) {
+	var payload BroadcastPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		log.Println("Cannot decode hub message:", err)
+		return
+	}
+
+	if payload.Role == "" {
+		for _, client := range h.localClients(payload.SessionId, payload.Except) {
+			h.send(client, payload.Message)
+		}
+		return
+	}
+
+	client := h.GetClient(payload.SessionId, payload.Role)
+	if client == nil {
+		return
+	}
+	h.send(client, payload.Message)
+	if payload.ExpiresAt != nil {
+		h.TrackSession(payload.SessionId, *payload.ExpiresAt)
+	}
+	if payload.Close {
+		h.LeaveSession(client, payload.SessionId)
+	}
+}
+
+// A message the broker dropped may have been meant for any client of the
+// session. They are disconnected so they resume the session and pick up
+// its current state instead of waiting for something that never comes.
+func (h *Hub) disconnectDropped(channel string) {
+	h.mutex.RLock()
+	sessionId, ok := h.channels[channel]
+	var clients []*Client
+	if ok {
+		for _, client := range h.connections[sessionId] {
+			clients = append(clients, client)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, client := range clients {
+		log.Println("Disconnecting client that missed a session message:", client.id)
+		client.CloseWithReason(websocket.CloseTryAgainLater, "missed messages, resume the session")
+	}
+}
+
+// Messages dropped for a full queue are already logged by the client.
+func (h *Hub) send(client *Client, message []byte) {
+	if err := client.Send(message); err != nil && !errors.Is(err, ErrQueueFull) {
+		log.Println("Cannot deliver hub message:", err)
+	}
+}
+
+// Returns the clients of the session connected to this instance, leaving
+// out the one holding `except`.
+func (h *Hub) localClients(sessionId string, except Role) []*Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(h.connections[sessionId]))
+	for role, client := range h.connections[sessionId] {
+		if role != except {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func sessionChannel(sessionId string) string {
+	return SESSION_CHANNEL_PREFIX + utils.HashSessionId(sessionId)
+}
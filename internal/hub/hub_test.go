@@ -0,0 +1,163 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+)
+
+// Open sockets the benchmarks run against. The cost per operation should
+// not grow with them.
+var benchmarkSockets = []int{100, 10_000, 50_000}
+
+func newTestClient() *Client {
+	return &Client{
+		send:      make(chan []byte, 256+REPLY_QUEUE_RESERVE),
+		queueSize: 256,
+		done:      make(chan struct{}),
+		released:  make(chan struct{}),
+		policy:    PolicyDrop,
+		counters:  &counters{},
+	}
+}
+
+// Builds a hub where every socket is the offerer of a session of its own.
+func newTestHub(b *testing.B, sockets int) (*Hub, []*Client) {
+	b.Helper()
+
+	h := NewHub(&settings.Settings{}, cache.NewMemoryBroker())
+	clients := make([]*Client, sockets)
+	for i := range clients {
+		clients[i] = newTestClient()
+		h.AddSession(clients[i], fmt.Sprintf("session-%d", i), Offerer)
+	}
+	return h, clients
+}
+
+// Memory broker that runs a hook before unsubscribing, to join a session
+// right while its channel is being dropped.
+type hookedBroker struct {
+	*cache.MemoryBroker
+	beforeUnsubscribe func()
+}
+
+func (b *hookedBroker) Unsubscribe(channels ...string) error {
+	if b.beforeUnsubscribe != nil {
+		b.beforeUnsubscribe()
+	}
+	return b.MemoryBroker.Unsubscribe(channels...)
+}
+
+// A client joining a session while its last client leaves must end up
+// subscribed to the session channel.
+func TestAddSessionWhileLastClientLeaves(t *testing.T) {
+	broker := &hookedBroker{MemoryBroker: cache.NewMemoryBroker()}
+	h := NewHub(&settings.Settings{}, broker)
+	leaving, joining := newTestClient(), newTestClient()
+	h.AddSession(leaving, "session", Offerer)
+
+	var wg sync.WaitGroup
+	broker.beforeUnsubscribe = func() {
+		broker.beforeUnsubscribe = nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.AddSession(joining, "session", Answerer)
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	h.RemoveSession(leaving)
+	wg.Wait()
+
+	broker.Publish(sessionChannel("session"), []byte("{}"))
+	select {
+	case <-broker.Messages():
+	default:
+		t.Fatal("session channel unsubscribed while a client holds it")
+	}
+}
+
+// The clients of a session whose message was dropped are disconnected so
+// they resume, the clients of other sessions stay.
+func TestDroppedMessageDisconnects(t *testing.T) {
+	broker := cache.NewMemoryBroker()
+	h := NewHub(&settings.Settings{}, broker)
+	offerer, answerer, other := newTestClient(), newTestClient(), newTestClient()
+	h.AddSession(offerer, "session", Offerer)
+	h.AddSession(answerer, "session", Answerer)
+	h.AddSession(other, "other", Offerer)
+
+	for i := 0; i <= cache.BROKER_BUFFER_SIZE; i++ {
+		h.BroadcastMessage(BroadcastPayload{SessionId: "session", Role: Answerer, Message: json.RawMessage(`{}`)})
+	}
+
+	for _, client := range []*Client{offerer, answerer} {
+		select {
+		case <-client.done:
+		default:
+			t.Fatal("client of the session kept after a dropped message")
+		}
+	}
+	select {
+	case <-other.done:
+		t.Fatal("client of another session disconnected")
+	default:
+	}
+}
+
+func BenchmarkDeliver(b *testing.B) {
+	for _, sockets := range benchmarkSockets {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			h, clients := newTestHub(b, sockets)
+			target := clients[sockets/2]
+			payload, _ := json.Marshal(BroadcastPayload{
+				SessionId: fmt.Sprintf("session-%d", sockets/2),
+				Role:      Offerer,
+				Message:   json.RawMessage(`{}`),
+			})
+			message := cache.BrokerMessage{Payload: payload}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.deliver(message)
+				<-target.send
+			}
+		})
+	}
+}
+
+func BenchmarkCheckClientHasActiveSession(b *testing.B) {
+	for _, sockets := range benchmarkSockets {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			h, _ := newTestHub(b, sockets)
+			idle := newTestClient()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if h.CheckClientHasActiveSession(idle) {
+					b.Fatal("idle client reported with an active session")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddRemoveSession(b *testing.B) {
+	for _, sockets := range benchmarkSockets {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			h, _ := newTestHub(b, sockets)
+			client := newTestClient()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.AddSession(client, "churn", Answerer)
+				h.RemoveSession(client)
+			}
+		})
+	}
+}
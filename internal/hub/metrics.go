@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"sync/atomic"
+)
+
+// Delivery counters shared by the clients of a hub.
+type counters struct {
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+}
+
+// Snapshot of the delivery state of a hub, served on `/api/v1/metrics/` of
+// the internal listener, see `settings.MetricsAddr`.
+// Queue figures cover the clients connected to this instance only.
+type Metrics struct {
+	Clients                 int   `json:"clients"`
+	Sessions                int   `json:"sessions"`
+	QueueCapacity           int   `json:"queueCapacity"`
+	QueuedMessages          int   `json:"queuedMessages"`
+	MaxQueueDepth           int   `json:"maxQueueDepth"`
+	DroppedMessages         int64 `json:"droppedMessages"`
+	SlowConsumerDisconnects int64 `json:"slowConsumerDisconnects"`
+	// Messages the broker dropped because the hub did not keep up.
+	BrokerDroppedMessages int64 `json:"brokerDroppedMessages"`
+}
+
+func (h *Hub) Metrics() Metrics {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	metrics := Metrics{
+		Clients:                 len(h.clients),
+		Sessions:                len(h.connections),
+		QueueCapacity:           h.config.WSSendQueueSize,
+		DroppedMessages:         h.counters.dropped.Load(),
+		SlowConsumerDisconnects: h.counters.disconnected.Load(),
+		BrokerDroppedMessages:   h.broker.Dropped(),
+	}
+	for client := range h.clients {
+		depth := len(client.send)
+		metrics.QueuedMessages += depth
+		metrics.MaxQueueDepth = max(metrics.MaxQueueDepth, depth)
+	}
+	return metrics
+}
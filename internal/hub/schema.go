@@ -2,11 +2,19 @@ package hub
 
 import (
 	"encoding/json"
-
-	"github.com/gorilla/websocket"
+	"time"
 )
 
+// Message addressed to one peer of a session, wherever it is connected.
+// It travels through the broker as is. Without a role it is addressed to
+// every peer of the session except the one holding `Except`.
 type BroadcastPayload struct {
-	Conn    *websocket.Conn
-	Message json.RawMessage
+	SessionId string          `json:"sessionId"`
+	Role      Role            `json:"role,omitempty"`
+	Except    Role            `json:"except,omitempty"`
+	Message   json.RawMessage `json:"message"`
+	// Detaches the receiving client from the session once delivered.
+	Close bool `json:"close,omitempty"`
+	// New deadline of the session, tracked by the receiving hub.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+)
+
+// Reserves the single answerer slot of the session for the connection.
+// The slot lives in the store so only one answer is accepted even when
+// competing answers reach different instances at the same time.
+func (s *Server) claimAnswerer(record *session.Record, client *hub.Client) error {
+	sessionId := record.Id
+	claimed, err := s.store.SetNX(answererKey(sessionId), client.Id(), keyTTL(record))
+	if err != nil {
+		log.Println("Cannot claim the answerer slot:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+	if !claimed {
+		s.notifyAnswerRejected(sessionId)
+		return &SessionError{Code: CodeInvalidState, Message: "Session already answered"}
+	}
+	return nil
+}
+
+// Frees the slot when the answer could not be completed.
+func (s *Server) releaseAnswerer(sessionId string) {
+	if err := s.store.Del(answererKey(sessionId)); err != nil {
+		log.Println("Cannot release the answerer slot:", err)
+	}
+}
+
+// Lets the offerer know that someone else tried to answer its session.
+func (s *Server) notifyAnswerRejected(sessionId string) {
+	payload, _ := json.Marshal(AnswerRejectedPayload{
+		SessionId: sessionId,
+		Message:   "Another answer to this session was rejected",
+	})
+	rawPayload, _ := json.Marshal(SessionMessage{Type: AnswerRejected, Payload: payload})
+
+	if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+		SessionId: sessionId,
+		Role:      hub.Offerer,
+		Message:   rawPayload,
+	}); err != nil {
+		log.Println("Cannot notify the offerer:", err)
+	}
+}
+
+func answererKey(sessionId string) string {
+	return peerKey(sessionId, hub.Answerer)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Only one of several answerers racing for a session gets a PIN, the
+// others are rejected and the offerer hears about them.
+func TestAnswererClaim(t *testing.T) {
+	const answerers = 8
+
+	rejected := make(chan struct{}, answerers)
+	ts := newTestServer(t)
+	offerer := ts.dial(t, signaling.WithEventHandler(func(msg signaling.Message) {
+		if msg.Type == signaling.TypeAnswerRejected {
+			rejected <- struct{}{}
+		}
+	}))
+	if _, err := offerer.CreateSession(testContext(t), testOffer("session")); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	clients := make([]*signaling.Client, answerers)
+	for i := range clients {
+		clients[i] = ts.dial(t)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, answerers)
+	pins := make([]string, answerers)
+	for i, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pins[i], errs[i] = client.SendAnswer(testContext(t), testAnswer("session"))
+		}()
+	}
+	wg.Wait()
+
+	var pin string
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if pin != "" {
+				t.Fatalf("two answers accepted")
+			}
+			pin = pins[i]
+		case !errors.Is(err, signaling.ErrInvalidState):
+			t.Fatalf("answer %d: got %v, want ErrInvalidState", i, err)
+		}
+	}
+	if pin == "" {
+		t.Fatal("no answer accepted")
+	}
+
+	for i := 1; i < answerers; i++ {
+		select {
+		case <-rejected:
+		case <-testContext(t).Done():
+			t.Fatalf("offerer notified of %d rejected answers, want %d", i-1, answerers-1)
+		}
+	}
+	if _, err := offerer.FetchAnswer(testContext(t), "session", pin); err != nil {
+		t.Fatalf("fetch answer: %v", err)
+	}
+}
+
+// The slot may have been claimed through another instance sharing the
+// store, the session record alone does not show it yet.
+func TestAnswererClaimedElsewhere(t *testing.T) {
+	ts := newTestServer(t)
+	ts.offer(t, "session")
+	if err := ts.store.Set(answererKey("session"), "other-instance", 60); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	if _, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session")); !errors.Is(err, signaling.ErrInvalidState) {
+		t.Fatalf("got %v, want ErrInvalidState", err)
+	}
+	if _, err := ts.store.Get(pinKey("session")); err == nil {
+		t.Fatal("PIN issued for a claimed session")
+	}
+}
+
+// An answer that loses the race to store the session leaves neither its
+// claim nor its PIN behind, so the session can still be answered.
+func TestAnswerRolledBackOnConflict(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	ts.offer(t, "session")
+
+	store.before("session", func() {
+		record, err := ts.sessions.Load("session")
+		if err != nil {
+			t.Errorf("load: %v", err)
+			return
+		}
+		record.ExpiresAt = record.ExpiresAt.Add(time.Minute)
+		if err := ts.sessions.Save(record); err != nil {
+			t.Errorf("concurrent save: %v", err)
+		}
+	})
+	if _, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session")); !errors.Is(err, signaling.ErrConflict) {
+		t.Fatalf("got %v, want ErrConflict", err)
+	}
+	for _, key := range []string{answererKey("session"), pinKey("session")} {
+		if _, err := store.Store.Get(key); !errors.Is(err, cache.ErrKeyNotFound) {
+			t.Fatalf("%s left behind: %v", key, err)
+		}
+	}
+
+	if _, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session")); err != nil {
+		t.Fatalf("answer after the conflict: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+// Broadcast sessions accept several answerers, called receivers. A receiver
+// joins with `join` and waits until the offerer approves it with an offer
+// made for that receiver alone, then answers like in a regular session.
+//
+// Every receiver has a session record of its own stored under
+// `<sessionId>/<receiverId>`, so it moves through the same states as a
+// regular session and keeps its own answer, PIN and candidate buffers.
+// Within that record the offerer keeps its role and the receiver acts as
+// `hub.Answerer`.
+const RECEIVER_SEPARATOR = "/"
+
+var (
+	ErrBroadcastSession    = &SessionError{Code: CodeInvalidState, Message: "Broadcast session, join it first"}
+	ErrNotBroadcastSession = &SessionError{Code: CodeInvalidState, Message: "Not a broadcast session"}
+	ErrSessionFull         = &SessionError{Code: CodeLimitReached, Message: "Session is full"}
+)
+
+// Adds a receiver to the broadcast session and lets the offerer know.
+func (s *Server) handleJoin(msg SessionRequest) (*ReceiverPayload, error) {
+	record, err := s.loadSession(msg.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Broadcast() {
+		return nil, ErrNotBroadcastSession
+	}
+	if record.State != session.Offered {
+		return nil, stateError(record.State)
+	}
+
+	// Receiver ids are handed out in order, so the counter also bounds the
+	// number of receivers. Ids are not reused once a receiver leaves.
+	count, err := s.store.Incr(receiversKey(msg.SessionId), keyTTL(record))
+	if err != nil {
+		log.Println("Cannot count the receivers:", err)
+		return nil, fmt.Errorf("A server error ocurred")
+	}
+	if count > int64(record.MaxReceivers) {
+		return nil, ErrSessionFull
+	}
+
+	receiverId := strconv.FormatInt(count, 10)
+	if _, err := s.sessions.Create(receiverSessionId(msg.SessionId, receiverId), record.Remaining()); err != nil {
+		log.Println("Cannot create the receiver:", err)
+		return nil, fmt.Errorf("A server error ocurred")
+	}
+
+	joined := ReceiverPayload{SessionId: msg.SessionId, ReceiverId: receiverId}
+	s.sendToRole(msg.SessionId, hub.Offerer, ReceiverJoined, joined, false)
+
+	return &joined, nil
+}
+
+func (s *Server) handleListReceivers(msg SessionRequest, client *hub.Client) (*ReceiversResponse, error) {
+	if role, ok := s.hub.GetRole(client, msg.SessionId); !ok || role != hub.Offerer {
+		return nil, fmt.Errorf("Not part of this session")
+	}
+	record, err := s.loadSession(msg.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Broadcast() {
+		return nil, ErrNotBroadcastSession
+	}
+
+	receivers := []ReceiverPayload{}
+	s.forEachReceiver(record, func(receiverId string, receiver *session.Record) {
+		receivers = append(receivers, ReceiverPayload{ReceiverId: receiverId, State: receiver.State})
+	})
+	return &ReceiversResponse{SessionId: msg.SessionId, Receivers: receivers}, nil
+}
+
+// Hands the offer the offerer made for a receiver to that receiver.
+func (s *Server) handleApproveReceiver(msg OfferRequest, client *hub.Client) (*AckResponse, error) {
+	if role, ok := s.hub.GetRole(client, msg.SessionId); !ok || role != hub.Offerer {
+		return nil, fmt.Errorf("Not part of this session")
+	}
+	if err := s.verifySignature(msg.SessionId, msg.OfferSDP, msg.PubKey, msg.SigningKey, msg.Timestamp, msg.Signature); err != nil {
+		return nil, err
+	}
+
+	receiver, err := s.loadSession(receiverSessionId(msg.SessionId, msg.ReceiverId))
+	if err != nil {
+		return nil, err
+	}
+	receiver.Offer, _ = json.Marshal(msg)
+	if err := s.transitionSession(receiver, session.Offered); err != nil {
+		return nil, err
+	}
+
+	s.sendToRole(msg.SessionId, hub.ReceiverRole(msg.ReceiverId), ReceiverApproved, ReceiverApprovedPayload{
+		SessionId:  msg.SessionId,
+		ReceiverId: msg.ReceiverId,
+		OfferSDP:   msg.OfferSDP,
+		PubKey:     msg.PubKey,
+		SigningKey: msg.SigningKey,
+		Timestamp:  msg.Timestamp,
+		Signature:  msg.Signature,
+	}, false)
+
+	return &AckResponse{Message: "Ok"}, nil
+}
+
+// Stores the answer of an approved receiver under its own PIN and asks the
+// offerer to confirm it.
+func (s *Server) handleReceiverAnswer(msg AnswerRequest, raw json.RawMessage, client *hub.Client) (*AnswerResponse, error) {
+	if role, ok := s.hub.GetRole(client, msg.SessionId); !ok || role != hub.ReceiverRole(msg.ReceiverId) {
+		return nil, fmt.Errorf("Not part of this session")
+	}
+	receiver, err := s.loadSession(receiverSessionId(msg.SessionId, msg.ReceiverId))
+	if err != nil {
+		return nil, err
+	}
+	if !receiver.CanTransition(session.Answered) {
+		return nil, stateError(receiver.State)
+	}
+	if err := s.verifySignature(msg.SessionId, msg.AnswerSDP, msg.PubKey, msg.SigningKey, msg.Timestamp, msg.Signature); err != nil {
+		return nil, err
+	}
+
+	pin, err := s.reservePIN(receiver)
+	if err != nil {
+		return nil, err
+	}
+
+	receiver.Answer = raw
+	if err := s.transitionSession(receiver, session.Answered); err != nil {
+		s.releasePIN(receiver.Id, pin)
+		return nil, err
+	}
+
+	s.sendToRole(msg.SessionId, hub.Offerer, ConfirmConnection, ReceiverPayload{
+		SessionId:  msg.SessionId,
+		ReceiverId: msg.ReceiverId,
+	}, false)
+
+	return &AnswerResponse{Message: "Ok", Pin: pin}, nil
+}
+
+// Ends a single receiver of a broadcast session. The receiver is detached
+// from the session and the offerer gets `receiver_left`.
+func (s *Server) closeReceiver(sessionId string, receiverId string, reason CloseReason) {
+	id := receiverSessionId(sessionId, receiverId)
+	if err := s.sessions.Close(id); err != nil && !errors.Is(err, session.ErrNotFound) {
+		log.Println("Cannot close the receiver:", err)
+	}
+	s.purgeSession(id)
+
+	payload := SessionClosedPayload{SessionId: sessionId, ReceiverId: receiverId, Reason: reason}
+	s.sendToRole(sessionId, hub.ReceiverRole(receiverId), SessionClosed, payload, true)
+	s.sendToRole(sessionId, hub.Offerer, ReceiverLeft, payload, false)
+}
+
+// Calls `fn` for every receiver record of the broadcast session that is
+// still stored.
+func (s *Server) forEachReceiver(record *session.Record, fn func(receiverId string, receiver *session.Record)) {
+	countRaw, err := s.store.Get(receiversKey(record.Id))
+	if err != nil {
+		if !errors.Is(err, cache.ErrKeyNotFound) {
+			log.Println("Cannot read the receivers:", err)
+		}
+		return
+	}
+	count, _ := strconv.Atoi(countRaw)
+
+	for i := 1; i <= min(count, record.MaxReceivers); i++ {
+		receiverId := strconv.Itoa(i)
+		receiver, err := s.sessions.Load(receiverSessionId(record.Id, receiverId))
+		if err != nil {
+			continue
+		}
+		fn(receiverId, receiver)
+	}
+}
+
+func (s *Server) sendToRole(sessionId string, role hub.Role, msgType SessionMessageType, payload any, detach bool) {
+	payloadRaw, _ := json.Marshal(payload)
+	rawMessage, _ := json.Marshal(SessionMessage{Type: msgType, Payload: payloadRaw})
+	if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+		SessionId: sessionId,
+		Role:      role,
+		Message:   rawMessage,
+		Close:     detach,
+	}); err != nil {
+		log.Println("Cannot notify the peer:", err)
+	}
+}
+
+func receiverSessionId(sessionId string, receiverId string) string {
+	return sessionId + RECEIVER_SEPARATOR + receiverId
+}
+
+func splitReceiverSessionId(id string) (string, string, bool) {
+	return strings.Cut(id, RECEIVER_SEPARATOR)
+}
+
+func receiversKey(sessionId string) string {
+	return utils.StoreKey("receivers", sessionId)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Creates a broadcast session for up to `maxReceivers` receivers.
+func (ts *testServer) broadcast(t *testing.T, sessionId string, maxReceivers int) *signaling.Client {
+	t.Helper()
+
+	offerer := ts.dial(t)
+	offer := testOffer(sessionId)
+	offer.MaxReceivers = maxReceivers
+	if _, err := offerer.CreateSession(testContext(t), offer); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return offerer
+}
+
+// Joins the broadcast session and has the offerer approve the receiver.
+func (ts *testServer) approvedReceiver(t *testing.T, offerer *signaling.Client, sessionId string) (*signaling.Client, string) {
+	t.Helper()
+
+	ctx := testContext(t)
+	receiver := ts.dial(t)
+	receiverId, err := receiver.JoinSession(ctx, sessionId)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	offer := testOffer(sessionId)
+	offer.ReceiverId = receiverId
+	if err := offerer.ApproveReceiver(ctx, offer); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if _, err := receiver.AwaitApproval(ctx); err != nil {
+		t.Fatalf("await approval: %v", err)
+	}
+	return receiver, receiverId
+}
+
+func receiverAnswer(sessionId string, receiverId string) signaling.Answer {
+	answer := testAnswer(sessionId)
+	answer.ReceiverId = receiverId
+	return answer
+}
+
+func TestBroadcastReceivers(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer := ts.broadcast(t, "session", 2)
+
+	receivers := map[string]*signaling.Client{}
+	for i := 0; i < 2; i++ {
+		receiver, receiverId := ts.approvedReceiver(t, offerer, "session")
+		receivers[receiverId] = receiver
+	}
+
+	for receiverId, receiver := range receivers {
+		pin, err := receiver.SendAnswer(ctx, receiverAnswer("session", receiverId))
+		if err != nil {
+			t.Fatalf("answer of receiver %s: %v", receiverId, err)
+		}
+		if answered, err := offerer.AwaitReceiverAnswer(ctx); err != nil || answered != receiverId {
+			t.Fatalf("offerer told about receiver %q (%v), want %s", answered, err, receiverId)
+		}
+		if _, err := offerer.FetchReceiverAnswer(ctx, "session", receiverId, pin); err != nil {
+			t.Fatalf("fetch answer of receiver %s: %v", receiverId, err)
+		}
+	}
+
+	listed, err := offerer.ListReceivers(ctx, "session")
+	if err != nil {
+		t.Fatalf("list receivers: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("listed %d receivers, want 2", len(listed))
+	}
+}
+
+func TestBroadcastReceiverLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	ts.broadcast(t, "session", 2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.dial(t).JoinSession(ctx, "session"); err != nil {
+			t.Fatalf("join %d: %v", i, err)
+		}
+	}
+	if _, err := ts.dial(t).JoinSession(ctx, "session"); !errors.Is(err, signaling.ErrSessionFull) {
+		t.Fatalf("join past the limit: got %v, want ErrSessionFull", err)
+	}
+}
+
+// Receiver records live under `<sessionId>/<receiverId>`, they must only
+// be reachable through the broadcast session by the receiver holding them.
+func TestBroadcastReceiverScope(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer := ts.broadcast(t, "session", 2)
+	first, firstId := ts.approvedReceiver(t, offerer, "session")
+	second, secondId := ts.approvedReceiver(t, offerer, "session")
+
+	if _, err := first.SendAnswer(ctx, receiverAnswer("session", secondId)); serverMessage(err) != "Not part of this session" {
+		t.Fatalf("receiver answered for another receiver: %v", err)
+	}
+	if _, err := ts.dial(t).SendAnswer(ctx, testAnswer("session/"+firstId)); serverMessage(err) != "Invalid session id" {
+		t.Fatalf("receiver record reached by its id: %v", err)
+	}
+	if _, err := ts.dial(t).FetchOffer(ctx, "session"); !errors.Is(err, signaling.ErrInvalidState) {
+		t.Fatalf("offer of a broadcast session fetched: %v", err)
+	}
+
+	firstPIN, err := first.SendAnswer(ctx, receiverAnswer("session", firstId))
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	if _, err := second.SendAnswer(ctx, receiverAnswer("session", secondId)); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	if _, err := second.FetchReceiverAnswer(ctx, "session", firstId, firstPIN); serverMessage(err) != "Not part of this session" {
+		t.Fatalf("receiver fetched the answer of another receiver: %v", err)
+	}
+	if _, err := offerer.FetchReceiverAnswer(ctx, "session", secondId, firstPIN); !errors.Is(err, signaling.ErrInvalidPIN) {
+		t.Fatalf("PIN of a receiver used for another one: got %v, want ErrInvalidPIN", err)
+	}
+}
+
+func serverMessage(err error) string {
+	var serverErr *signaling.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Message
+	}
+	return ""
+}
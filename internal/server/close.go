@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+)
+
+// Ends the session on request of one of its peers and lets the other one
+// know. A receiver of a broadcast session only ends its own part.
+func (s *Server) handleCancelSession(msg SessionRequest, client *hub.Client) (*AckResponse, error) {
+	role, ok := s.hub.GetRole(client, msg.SessionId)
+	if !ok {
+		return nil, fmt.Errorf("Not part of this session")
+	}
+
+	s.hub.LeaveSession(client, msg.SessionId)
+	if receiverId, ok := role.ReceiverId(); ok {
+		s.closeReceiver(msg.SessionId, receiverId, ReasonCancelled)
+	} else {
+		s.closeSession(msg.SessionId, ReasonCancelled, otherRole(role))
+	}
+
+	return &AckResponse{Message: "Ok"}, nil
+}
+
+// Closes the session record, drops everything stored next to it and sends
+// `session_closed` to the given roles. The PIN attempt counter is kept so
+// further attempts on a locked session keep failing with `ErrPINLocked`.
+// Closing a broadcast session closes each of its receivers, closing the
+// record of a single receiver only ends that receiver.
+func (s *Server) closeSession(sessionId string, reason CloseReason, notify ...hub.Role) {
+	if parentId, receiverId, ok := splitReceiverSessionId(sessionId); ok {
+		s.closeReceiver(parentId, receiverId, reason)
+		return
+	}
+	if record, err := s.sessions.Load(sessionId); err == nil && record.Broadcast() {
+		s.forEachReceiver(record, func(receiverId string, receiver *session.Record) {
+			if !receiver.Terminal() {
+				s.closeReceiver(sessionId, receiverId, reason)
+			}
+		})
+	}
+
+	if err := s.sessions.Close(sessionId); err != nil && !errors.Is(err, session.ErrNotFound) {
+		log.Println("Cannot close the session:", err)
+	}
+	s.purgeSession(sessionId)
+
+	payload, _ := json.Marshal(SessionClosedPayload{SessionId: sessionId, Reason: reason})
+	rawPayload, _ := json.Marshal(SessionMessage{Type: SessionClosed, Payload: payload})
+	for _, role := range notify {
+		if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+			SessionId: sessionId,
+			Role:      role,
+			Message:   rawPayload,
+			Close:     true,
+		}); err != nil {
+			log.Println("Cannot notify the peer:", err)
+		}
+	}
+}
+
+// Drops the PIN, the answerer slot and the candidate buffers of a session
+// that ended.
+func (s *Server) purgeSession(sessionId string) {
+	if pin, err := s.store.GetDel(pinKey(sessionId)); err == nil {
+		if err := s.pins.RemovePIN(pin); err != nil {
+			log.Println("Cannot release the PIN:", err)
+		}
+	}
+
+	for _, key := range sessionKeys(sessionId) {
+		if err := s.store.Del(key); err != nil {
+			log.Println("Cannot delete the session data:", err)
+		}
+	}
+}
+
+// Keys stored next to the session record, apart from the PIN.
+func sessionKeys(sessionId string) []string {
+	keys := []string{receiversKey(sessionId)}
+	for _, role := range []hub.Role{hub.Offerer, hub.Answerer} {
+		keys = append(keys,
+			peerKey(sessionId, role),
+			resumeKey(sessionId, role),
+			candidatesKey(sessionId, role),
+			readyKey(sessionId, role),
+		)
+	}
+	return keys
+}
+
+func otherRole(role hub.Role) hub.Role {
+	if role == hub.Offerer {
+		return hub.Answerer
+	}
+	return hub.Offerer
+}
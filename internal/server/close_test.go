@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Dials a connection that collects the reasons of the `session_closed`
+// messages pushed to it.
+func (ts *testServer) dialClosed(t *testing.T) (*signaling.Client, chan string) {
+	t.Helper()
+
+	reasons := make(chan string, 4)
+	client := ts.dial(t, signaling.WithEventHandler(func(msg signaling.Message) {
+		var payload signaling.SessionClosed
+		if msg.Type == signaling.TypeSessionClosed && json.Unmarshal(msg.Payload, &payload) == nil {
+			reasons <- payload.Reason
+		}
+	}))
+	return client, reasons
+}
+
+func expectClosed(t *testing.T, reasons chan string, want CloseReason) {
+	t.Helper()
+
+	select {
+	case reason := <-reasons:
+		if reason != string(want) {
+			t.Fatalf("closed for %s, want %s", reason, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("peer not told the session closed")
+	}
+}
+
+func TestCancelNotifiesPeer(t *testing.T) {
+	tests := []struct {
+		name string
+		// Cancels as one peer, the other one must be notified.
+		cancelByOfferer bool
+	}{
+		{"offerer cancels", true},
+		{"answerer cancels", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ctx := testContext(t)
+			offerer, offererClosed := ts.dialClosed(t)
+			if _, err := offerer.CreateSession(ctx, testOffer("session")); err != nil {
+				t.Fatalf("create session: %v", err)
+			}
+			answerer, answererClosed := ts.dialClosed(t)
+			if _, err := answerer.SendAnswer(ctx, testAnswer("session")); err != nil {
+				t.Fatalf("answer: %v", err)
+			}
+
+			canceller, notified := answerer, offererClosed
+			if tt.cancelByOfferer {
+				canceller, notified = offerer, answererClosed
+			}
+			if err := canceller.CancelSession(ctx, "session"); err != nil {
+				t.Fatalf("cancel: %v", err)
+			}
+			expectClosed(t, notified, ReasonCancelled)
+
+			if _, err := ts.store.Get(pinKey("session")); !errors.Is(err, cache.ErrKeyNotFound) {
+				t.Fatalf("PIN kept after cancel: %v", err)
+			}
+			if _, err := offerer.FetchAnswer(ctx, "session", "000000"); !errors.Is(err, signaling.ErrSessionClosed) {
+				t.Fatalf("fetch after cancel: got %v, want ErrSessionClosed", err)
+			}
+		})
+	}
+}
+
+func TestCancelNotPartOfSession(t *testing.T) {
+	ts := newTestServer(t)
+	ts.offer(t, "session")
+
+	if err := ts.dial(t).CancelSession(testContext(t), "session"); err == nil {
+		t.Fatal("session cancelled by a client outside of it")
+	}
+	if _, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session")); err != nil {
+		t.Fatalf("answer after the rejected cancel: %v", err)
+	}
+}
+
+// A peer that drops and does not resume in time closes the session for
+// the other one.
+func TestDisconnectNotifiesPeer(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.ResumeGracePeriod = 10 * time.Millisecond
+	})
+	ctx := testContext(t)
+	offerer, closed := ts.dialClosed(t)
+	if _, err := offerer.CreateSession(ctx, testOffer("session")); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	answerer := ts.dial(t)
+	if _, err := answerer.SendAnswer(ctx, testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+
+	answerer.Close()
+	expectClosed(t, closed, ReasonDisconnected)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+)
+
+var ErrLifetimeLimit = &SessionError{Code: CodeLimitReached, Message: "Session cannot be extended any further"}
+
+// Starts watching the deadline of a session the client just joined.
+func (s *Server) trackSession(sessionId string) {
+	record, err := s.sessions.Load(sessionId)
+	if err != nil {
+		log.Println("Cannot load the session:", err)
+		return
+	}
+	s.hub.TrackSession(sessionId, record.ExpiresAt)
+}
+
+// Pushes the session deadline to the peers once the hub sees it get close.
+func (s *Server) sessionExpiring(sessionId string, expiresAt time.Time) {
+	s.sendExpiry(sessionId, SessionExpiring, &expiresAt, false)
+}
+
+// Called by the hub once the session deadline passed. A peer connected to
+// another instance may have extended the session in the meantime, in which
+// case the new deadline is tracked instead.
+func (s *Server) sessionExpired(sessionId string) {
+	record, err := s.sessions.Load(sessionId)
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		log.Println("Cannot load the expired session:", err)
+		return
+	}
+	if record != nil && !record.Terminal() {
+		s.hub.TrackSession(sessionId, record.ExpiresAt)
+		return
+	}
+
+	if record != nil && record.Broadcast() {
+		s.forEachReceiver(record, func(receiverId string, receiver *session.Record) {
+			if err := s.sessions.Expire(receiver.Id); err != nil {
+				log.Println("Cannot expire the receiver:", err)
+			}
+			s.purgeSession(receiver.Id)
+		})
+	}
+	if err := s.sessions.Expire(sessionId); err != nil && !errors.Is(err, session.ErrNotFound) {
+		log.Println("Cannot expire the session:", err)
+	}
+	s.purgeSession(sessionId)
+	s.sendExpiry(sessionId, SessionExpired, nil, true)
+}
+
+func (s *Server) sendExpiry(sessionId string, msgType SessionMessageType, expiresAt *time.Time, detach bool) {
+	payload, _ := json.Marshal(SessionExpiryPayload{SessionId: sessionId, ExpiresAt: expiresAt})
+	rawPayload, _ := json.Marshal(SessionMessage{Type: msgType, Payload: payload})
+	s.hub.SendLocal(sessionId, rawPayload, detach)
+}
+
+// Pushes the session deadline back by a full lifetime, capped at
+// `SessionMaxLifetime` after its creation. The data stored next to the
+// record is kept alive for as long as the record and the other peers are
+// told about the new deadline. The receivers of a broadcast session are
+// extended along with it.
+func (s *Server) handleExtendSession(msg SessionRequest, client *hub.Client) (*SessionExpiryPayload, error) {
+	role, ok := s.hub.GetRole(client, msg.SessionId)
+	if !ok {
+		return nil, fmt.Errorf("Not part of this session")
+	}
+	record, err := s.loadSession(msg.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	if record.Terminal() {
+		return nil, stateError(record.State)
+	}
+
+	expiresAt := time.Now().Add(record.Lifetime)
+	if limit := record.CreatedAt.Add(s.config.SessionMaxLifetime); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	if !expiresAt.After(record.ExpiresAt) {
+		return nil, ErrLifetimeLimit
+	}
+
+	record.ExpiresAt = expiresAt
+	if err := s.saveSession(record); err != nil {
+		return nil, err
+	}
+	s.refreshSessionKeys(record)
+	s.hub.TrackSession(msg.SessionId, expiresAt)
+
+	notify := []hub.Role{otherRole(role)}
+	if record.Broadcast() {
+		s.forEachReceiver(record, func(receiverId string, receiver *session.Record) {
+			if receiver.Terminal() {
+				return
+			}
+			receiver.ExpiresAt = expiresAt
+			if err := s.sessions.Save(receiver); err != nil {
+				log.Println("Cannot save the receiver:", err)
+			}
+			s.refreshSessionKeys(receiver)
+			if receiverRole := hub.ReceiverRole(receiverId); receiverRole != role {
+				notify = append(notify, receiverRole)
+			}
+		})
+	}
+
+	payload, _ := json.Marshal(SessionExpiryPayload{SessionId: msg.SessionId, ExpiresAt: &expiresAt})
+	rawPayload, _ := json.Marshal(SessionMessage{Type: SessionExtended, Payload: payload})
+	for _, target := range notify {
+		if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+			SessionId: msg.SessionId,
+			Role:      target,
+			Message:   rawPayload,
+			ExpiresAt: &expiresAt,
+		}); err != nil {
+			log.Println("Cannot notify the peer:", err)
+		}
+	}
+
+	return &SessionExpiryPayload{SessionId: msg.SessionId, ExpiresAt: &expiresAt}, nil
+}
+
+// Keys are only given the new TTL, never written again, so data deleted
+// meanwhile such as a consumed PIN stays deleted.
+func (s *Server) refreshSessionKeys(record *session.Record) {
+	ttls := map[string]int{pinKey(record.Id): s.pinTTL(record)}
+	for _, key := range sessionKeys(record.Id) {
+		ttls[key] = keyTTL(record)
+	}
+
+	for key, ttl := range ttls {
+		if _, err := s.store.Expire(key, ttl); err != nil {
+			log.Println("Cannot refresh the session data:", err)
+		}
+	}
+}
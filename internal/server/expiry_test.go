@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Dials a connection that collects the types of the events pushed to it.
+func (ts *testServer) dialEvents(t *testing.T) (*signaling.Client, chan string) {
+	t.Helper()
+
+	events := make(chan string, 16)
+	client := ts.dial(t, signaling.WithEventHandler(func(msg signaling.Message) {
+		events <- msg.Type
+	}))
+	return client, events
+}
+
+func expectEvent(t *testing.T, events chan string, want string) {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event := <-events:
+			if event == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestExtendSession(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.SessionTTL = time.Minute
+	})
+	ctx := testContext(t)
+	offerer, _ := ts.offer(t, "session")
+	before, _ := ts.sessions.Load("session")
+
+	answerer, events := ts.dialEvents(t)
+	if _, err := answerer.SendAnswer(ctx, testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	expiresAt, err := offerer.ExtendSession(ctx, "session")
+	if err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if !expiresAt.After(before.ExpiresAt) {
+		t.Fatalf("deadline %v not after %v", expiresAt, before.ExpiresAt)
+	}
+	expectEvent(t, events, signaling.TypeSessionExtended)
+
+	after, _ := ts.sessions.Load("session")
+	if !after.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("stored deadline %v, want %v", after.ExpiresAt, expiresAt)
+	}
+}
+
+func TestExtendSessionCapped(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.SessionTTL = time.Minute
+		config.SessionMaxLifetime = 90 * time.Second
+	})
+	ctx := testContext(t)
+	offerer, _ := ts.offer(t, "session")
+
+	// A full lifetime from now ends past the limit of a session created
+	// 45 seconds ago.
+	record, _ := ts.sessions.Load("session")
+	record.CreatedAt = record.CreatedAt.Add(-45 * time.Second)
+	record.ExpiresAt = record.ExpiresAt.Add(-45 * time.Second)
+	if err := ts.sessions.Save(record); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	expiresAt, err := offerer.ExtendSession(ctx, "session")
+	if err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if limit := record.CreatedAt.Add(90 * time.Second); !expiresAt.Equal(limit) {
+		t.Fatalf("deadline %v, want the limit %v", expiresAt, limit)
+	}
+	if _, err := offerer.ExtendSession(ctx, "session"); !errors.Is(err, signaling.ErrLimitReached) {
+		t.Fatalf("extending past the limit: got %v, want ErrLimitReached", err)
+	}
+}
+
+func TestExtendSessionNotJoined(t *testing.T) {
+	ts := newTestServer(t)
+	ts.offer(t, "session")
+
+	if _, err := ts.dial(t).ExtendSession(testContext(t), "session"); err == nil {
+		t.Fatal("session extended by a client outside of it")
+	}
+}
+
+// Refreshing the keys of a session must not bring back one deleted while
+// the refresh runs, like a PIN consumed at the same time.
+func TestRefreshSessionKeysKeepsDeleted(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	ts.offer(t, "session")
+	ts.answer(t, "session")
+
+	record, _ := ts.sessions.Load("session")
+	store.afterAccess(pinKey("session"), func() {
+		store.Del(pinKey("session"))
+	})
+	ts.refreshSessionKeys(record)
+
+	if _, err := store.Store.Get(pinKey("session")); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Fatalf("deleted PIN restored: %v", err)
+	}
+	if _, err := store.Store.Get(resumeKey("session", "offerer")); err != nil {
+		t.Fatalf("resume token lost: %v", err)
+	}
+}
+
+func TestSessionExpiryWarning(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.SessionExpiryWarning = time.Minute
+	})
+	ctx := testContext(t)
+	offerer, events := ts.dialEvents(t)
+
+	offer := testOffer("session")
+	offer.TTL = 2
+	if _, err := offerer.CreateSession(ctx, offer); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	expectEvent(t, events, signaling.TypeSessionExpiring)
+	if err := offerer.AwaitConfirmation(ctx); !errors.Is(err, signaling.ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if _, err := ts.dial(t).SendAnswer(ctx, testAnswer("session")); !errors.Is(err, signaling.ErrSessionExpired) {
+		t.Fatalf("answer after expiry: got %v, want ErrSessionExpired", err)
+	}
+}
@@ -5,8 +5,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 
-	"github.com/vladNed/hyperspace/internal/cache"
-	"github.com/vladNed/hyperspace/internal/settings"
 	"github.com/vladNed/hyperspace/internal/utils"
 )
 
@@ -16,6 +14,11 @@ func pingHandler(c *gin.Context) {
 	})
 }
 
+// Reports the hub delivery metrics of this instance.
+func (s *Server) metricsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.hub.Metrics())
+}
+
 func indexHandler(c *gin.Context) {
 	c.Header("Content-Type", "text/html")
 	c.Header("X-Cache", "HIT")
@@ -26,9 +29,8 @@ func indexHandler(c *gin.Context) {
 	})
 }
 
-func connectHandler(c *gin.Context) {
+func (s *Server) connectHandler(c *gin.Context) {
 	actionParam := c.Param("action")
-	settings := settings.GetInstance()
 	action, err := GetActionParameter(actionParam)
 	if err != nil {
 		c.HTML(http.StatusNotFound, "not-found-page.html", gin.H{})
@@ -38,11 +40,10 @@ func connectHandler(c *gin.Context) {
 	c.Header("Content-Type", "text/html")
 	switch action {
 	case StartAction:
-		cacheInstance := cache.NewRedis()
 		var sessionId string
 		for range 5 {
 			sessionId = utils.GetSessionId()
-			if _, err := cacheInstance.Get(sessionId); err != nil {
+			if _, err := s.store.Get(sessionId); err != nil {
 				break
 			}
 		}
@@ -50,14 +51,14 @@ func connectHandler(c *gin.Context) {
 			"title":       "SafeFiles | App",
 			"description": "SafeFiles is p2p secure file sharing application",
 			"sessionId":   sessionId,
-			"wsURL":       settings.WSOrigin + "/ws/v1/session/",
+			"wsURL":       s.config.WSOrigin + "/ws/v1/session/",
 		})
 		break
 	case JoinAction:
 		c.HTML(http.StatusOK, "session-join.html", gin.H{
 			"title":       "SafeFiles | App",
 			"description": "SafeFiles is p2p secure file sharing application",
-			"wsURL":       settings.WSOrigin + "/ws/v1/session/",
+			"wsURL":       s.config.WSOrigin + "/ws/v1/session/",
 		})
 		break
 	default:
@@ -66,11 +67,10 @@ func connectHandler(c *gin.Context) {
 	}
 }
 
-func sessionCommonHandler(c *gin.Context) {
+func (s *Server) sessionCommonHandler(c *gin.Context) {
 	sessionParam := c.Param("sessionId")
 	c.Header("Content-Type", "text/html")
-	cacheClient := cache.NewRedis()
-	if _, err := cacheClient.Get(sessionParam); err != nil {
+	if !s.sessionAvailable(sessionParam) {
 		c.HTML(http.StatusNotFound, "not-found.html", gin.H{})
 		return
 	}
@@ -79,11 +79,10 @@ func sessionCommonHandler(c *gin.Context) {
 	})
 }
 
-func connectingHandler(c *gin.Context) {
+func (s *Server) connectingHandler(c *gin.Context) {
 	sessionParam := c.Param("sessionId")
 	c.Header("Content-Type", "text/html")
-	cacheClient := cache.NewRedis()
-	if _, err := cacheClient.Get(sessionParam); err != nil {
+	if !s.sessionAvailable(sessionParam) {
 		c.HTML(http.StatusNotFound, "not-found-page.html", gin.H{})
 		return
 	}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+)
+
+// The message set of `/ws/v1/session/` is versioned so that it can evolve
+// without breaking deployed clients. Clients announce the highest version
+// they speak with `hello` and the server answers with the one both sides
+// use. Clients that never send `hello`, such as browser tabs loaded before
+// it existed, are served version 1 without any of the optional features.
+const (
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// Optional parts of the protocol, negotiated with `hello`.
+const (
+	FeatureTrickleICE    = "trickle_ice"
+	FeatureSignatures    = "signatures"
+	FeatureResume        = "resume"
+	FeatureExtendSession = "extend_session"
+	FeatureBroadcast     = "broadcast"
+	FeatureRooms         = "rooms"
+)
+
+var protocolFeatures = []string{
+	FeatureTrickleICE,
+	FeatureSignatures,
+	FeatureResume,
+	FeatureExtendSession,
+	FeatureBroadcast,
+	FeatureRooms,
+}
+
+// Messages only accepted from clients that negotiated their feature.
+// Offers and answers of broadcast sessions are checked by their handlers.
+var messageFeatures = map[SessionMessageType]string{
+	IceCandidate:     FeatureTrickleICE,
+	EndOfCandidates:  FeatureTrickleICE,
+	Resume:           FeatureResume,
+	ExtendSession:    FeatureExtendSession,
+	Join:             FeatureBroadcast,
+	ListReceivers:    FeatureBroadcast,
+	ApproveReceiver:  FeatureBroadcast,
+	JoinRoom:         FeatureRooms,
+	LeaveRoom:        FeatureRooms,
+	ListMembers:      FeatureRooms,
+	RoomOffer:        FeatureRooms,
+	RoomAnswer:       FeatureRooms,
+	RoomIceCandidate: FeatureRooms,
+}
+
+var ErrUnsupportedVersion = &SessionError{
+	Code:    CodeUnsupported,
+	Message: fmt.Sprintf("Unsupported protocol version, this server speaks versions %d to %d", MIN_PROTOCOL_VERSION, PROTOCOL_VERSION),
+}
+
+var ErrHelloRepeated = &SessionError{Code: CodeInvalidState, Message: "Hello already received"}
+
+// Rejects a request that needs a feature the client did not negotiate.
+func requireFeature(client *hub.Client, feature string) error {
+	if client.HasFeature(feature) {
+		return nil
+	}
+	return &SessionError{
+		Code:    CodeFeatureRequired,
+		Message: fmt.Sprintf("Feature %s was not negotiated with hello", feature),
+	}
+}
+
+func (s *Server) handleHello(msg HelloRequest, client *hub.Client) (*HelloResponse, error) {
+	if client.ProtocolVersion() != 0 {
+		return nil, ErrHelloRepeated
+	}
+	if msg.Version < MIN_PROTOCOL_VERSION {
+		return nil, ErrUnsupportedVersion
+	}
+
+	version := min(msg.Version, PROTOCOL_VERSION)
+	features := []string{}
+	for _, feature := range protocolFeatures {
+		if slices.Contains(msg.Features, feature) {
+			features = append(features, feature)
+		}
+	}
+	client.SetProtocol(version, features)
+
+	return &HelloResponse{
+		Version:  version,
+		Features: features,
+		Limits: ProtocolLimits{
+			SessionTTL:         int(s.config.SessionTTL.Seconds()),
+			MaxSessionLifetime: int(s.config.SessionMaxLifetime.Seconds()),
+			PINTTL:             int(s.config.PINTTL.Seconds()),
+			MaxMessageSize:     s.config.WSMaxMessageSize,
+			MaxReceivers:       s.config.BroadcastMaxReceivers,
+			MaxRoomMembers:     s.config.RoomMaxMembers,
+		},
+	}, nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Dials a bare connection, for requests the signal client cannot make.
+func (ts *testServer) dialRaw(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url, http.Header{"Origin": {"http://localhost"}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func rawRequest(t *testing.T, conn *websocket.Conn, msgType SessionMessageType, payload any) SessionMessage {
+	t.Helper()
+
+	payloadRaw, _ := json.Marshal(payload)
+	if err := conn.WriteJSON(SessionMessage{Type: msgType, Payload: payloadRaw}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var reply SessionMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return reply
+}
+
+func TestHelloUnsupportedVersion(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dialRaw(t)
+
+	reply := rawRequest(t, conn, Hello, HelloRequest{Client: "old", Version: MIN_PROTOCOL_VERSION - 1})
+	var resp ErrorResponse
+	json.Unmarshal(reply.Payload, &resp)
+	if reply.Type != Error || resp.Code != CodeUnsupported {
+		t.Fatalf("got %s %s, want an %s error", reply.Type, resp.Code, CodeUnsupported)
+	}
+
+	var msg SessionMessage
+	err := conn.ReadJSON(&msg)
+	if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("got %v, want the connection closed", err)
+	}
+}
+
+func TestHelloRepeated(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.dial(t)
+
+	if _, err := client.Hello(testContext(t), "test"); !errors.Is(err, signaling.ErrInvalidState) {
+		t.Fatalf("got %v, want ErrInvalidState", err)
+	}
+}
+
+func TestHelloFeatures(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dialRaw(t)
+
+	reply := rawRequest(t, conn, Hello, HelloRequest{
+		Client:   "test",
+		Version:  PROTOCOL_VERSION + 1,
+		Features: []string{FeatureRooms, "telepathy"},
+	})
+	var hello HelloResponse
+	if err := json.Unmarshal(reply.Payload, &hello); err != nil || reply.Type != Ok {
+		t.Fatalf("hello rejected: %s", reply.Payload)
+	}
+	if hello.Version != PROTOCOL_VERSION {
+		t.Fatalf("version %d, want %d", hello.Version, PROTOCOL_VERSION)
+	}
+	if !slices.Equal(hello.Features, []string{FeatureRooms}) {
+		t.Fatalf("features %v, want [%s]", hello.Features, FeatureRooms)
+	}
+
+	reply = rawRequest(t, conn, JoinRoom, RoomRequest{RoomId: "room", MemberId: "member"})
+	if reply.Type != Ok {
+		t.Fatalf("negotiated feature rejected: %s", reply.Payload)
+	}
+	reply = rawRequest(t, conn, ExtendSession, SessionRequest{SessionId: "session"})
+	var resp ErrorResponse
+	json.Unmarshal(reply.Payload, &resp)
+	if resp.Code != CodeFeatureRequired {
+		t.Fatalf("got %s %s, want a %s error", reply.Type, resp.Code, CodeFeatureRequired)
+	}
+}
+
+// Clients that never say hello keep the one-to-one flow only.
+func TestWithoutHello(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer := ts.dialWithoutHello(t)
+
+	if _, err := offerer.CreateSession(ctx, testOffer("session")); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if _, err := offerer.ExtendSession(ctx, "session"); !errors.Is(err, signaling.ErrNoFeature) {
+		t.Fatalf("extend: got %v, want ErrNoFeature", err)
+	}
+	if _, err := ts.dialWithoutHello(t).SendAnswer(ctx, testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+}
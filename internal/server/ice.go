@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+// Candidates buffered per peer until it is ready for them. A client sends a
+// handful per session, the cap keeps a peer from growing the store.
+const MAX_BUFFERED_CANDIDATES = 64
+
+// Forwards a trickled candidate to the other peer of the session. Until that
+// peer is able to apply candidates, i.e. it holds both descriptions, they are
+// buffered in the store and flushed by `flushCandidates`.
+//
+// Candidates between the offerer and a receiver of a broadcast session are
+// buffered under the receiver record, in which the receiver is the answerer.
+func (s *Server) handleIceCandidate(msg IceCandidateRequest, raw SessionMessage, client *hub.Client) error {
+	role, ok := s.hub.GetRole(client, msg.SessionId)
+	if !ok {
+		return fmt.Errorf("Not part of this session")
+	}
+
+	scope, target, deliverTo := msg.SessionId, hub.Answerer, hub.Answerer
+	if role == hub.Answerer {
+		target, deliverTo = hub.Offerer, hub.Offerer
+	}
+	if msg.ReceiverId != "" {
+		scope = receiverSessionId(msg.SessionId, msg.ReceiverId)
+		switch role {
+		case hub.Offerer:
+			deliverTo = hub.ReceiverRole(msg.ReceiverId)
+		case hub.ReceiverRole(msg.ReceiverId):
+			target, deliverTo = hub.Offerer, hub.Offerer
+		default:
+			return fmt.Errorf("Not part of this session")
+		}
+	} else if _, ok := role.ReceiverId(); ok {
+		return fmt.Errorf("Missing receiver id")
+	}
+
+	record, err := s.loadSession(scope)
+	if err != nil {
+		return err
+	}
+	if record.Terminal() {
+		return stateError(record.State)
+	}
+
+	rawMessage, _ := json.Marshal(raw)
+	relay := hub.BroadcastPayload{SessionId: msg.SessionId, Role: deliverTo, Message: rawMessage}
+	if s.peerReady(scope, target) {
+		if err := s.hub.BroadcastMessage(relay); err != nil {
+			log.Println("Cannot relay the candidate:", err)
+			return fmt.Errorf("Cannot reach the peer")
+		}
+		return nil
+	}
+
+	_, err = s.store.Push(candidatesKey(scope, target), rawMessage, MAX_BUFFERED_CANDIDATES, keyTTL(record))
+	if errors.Is(err, cache.ErrListFull) {
+		return &SessionError{Code: CodeLimitReached, Message: "Too many candidates buffered for the peer"}
+	}
+	if err != nil {
+		log.Println("Cannot buffer the candidate:", err)
+		return fmt.Errorf("Cannot save the candidate")
+	}
+
+	// The peer may have become ready and flushed the buffer while the
+	// candidate was being pushed. Whoever drains the buffer delivers it.
+	if s.peerReady(scope, target) {
+		for _, message := range s.drainCandidates(scope, target) {
+			relay.Message = message
+			if err := s.hub.BroadcastMessage(relay); err != nil {
+				log.Println("Cannot relay the candidate:", err)
+				return fmt.Errorf("Cannot reach the peer")
+			}
+		}
+	}
+	return nil
+}
+
+// Marks the peer as ready to receive candidates and sends it everything
+// buffered so far.
+func (s *Server) flushCandidates(sessionId string, role hub.Role, client *hub.Client) {
+	record, err := s.sessions.Load(sessionId)
+	if err != nil {
+		log.Println("Cannot load the session:", err)
+		return
+	}
+	if err := s.store.Set(readyKey(sessionId, role), "1", keyTTL(record)); err != nil {
+		log.Println("Cannot mark the peer as ready:", err)
+	}
+
+	for _, message := range s.drainCandidates(sessionId, role) {
+		if err := client.Send(message); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) peerReady(sessionId string, role hub.Role) bool {
+	_, err := s.store.Get(readyKey(sessionId, role))
+	return err == nil
+}
+
+// Takes the candidates buffered for the peer out of the store.
+func (s *Server) drainCandidates(sessionId string, role hub.Role) []json.RawMessage {
+	items, err := s.store.Drain(candidatesKey(sessionId, role))
+	if err != nil {
+		log.Println("Cannot read the buffered candidates:", err)
+		return nil
+	}
+
+	pending := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		pending[i] = json.RawMessage(item)
+	}
+	return pending
+}
+
+func candidatesKey(sessionId string, role hub.Role) string {
+	return utils.StoreKey("candidates", sessionId, string(role))
+}
+
+func readyKey(sessionId string, role hub.Role) string {
+	return utils.StoreKey("ready", sessionId, string(role))
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+// Dials a connection that collects the candidates relayed to it.
+func (ts *testServer) dialCandidates(t *testing.T) (*signaling.Client, chan string) {
+	t.Helper()
+
+	candidates := make(chan string, 2*MAX_BUFFERED_CANDIDATES)
+	client := ts.dial(t, signaling.WithCandidateHandler(func(candidate *signaling.ICECandidate) {
+		if candidate != nil {
+			candidates <- candidate.Candidate
+		}
+	}))
+	return client, candidates
+}
+
+func sendCandidates(t *testing.T, client *signaling.Client, from int, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		candidate := &signaling.ICECandidate{Candidate: "candidate:" + strconv.Itoa(i)}
+		if err := client.SendCandidate("session", candidate); err != nil {
+			t.Fatalf("send candidate: %v", err)
+		}
+	}
+}
+
+// Waits for `count` candidates and fails on any duplicate or extra one.
+func expectCandidates(t *testing.T, candidates chan string, count int) {
+	t.Helper()
+
+	seen := map[string]bool{}
+	for len(seen) < count {
+		select {
+		case candidate := <-candidates:
+			if seen[candidate] {
+				t.Fatalf("%s delivered twice", candidate)
+			}
+			seen[candidate] = true
+		case <-time.After(testTimeout):
+			t.Fatalf("got %d candidates, want %d", len(seen), count)
+		}
+	}
+	select {
+	case candidate := <-candidates:
+		t.Fatalf("unexpected candidate %s", candidate)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCandidatesBufferedUntilReady(t *testing.T) {
+	ts := newTestServer(t)
+	offerer, _ := ts.offer(t, "session")
+	sendCandidates(t, offerer, 0, 3)
+
+	answerer, candidates := ts.dialCandidates(t)
+	if _, err := answerer.SendAnswer(testContext(t), testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	expectCandidates(t, candidates, 3)
+
+	// Once the answerer is ready candidates are relayed right away.
+	sendCandidates(t, offerer, 3, 5)
+	expectCandidates(t, candidates, 2)
+}
+
+func TestCandidatesBufferCapped(t *testing.T) {
+	errs := make(chan ErrorCode, 1)
+	ts := newTestServer(t)
+	offerer := ts.dial(t, signaling.WithEventHandler(func(msg signaling.Message) {
+		var resp struct {
+			Code ErrorCode `json:"code"`
+		}
+		if msg.Type == signaling.TypeError && json.Unmarshal(msg.Payload, &resp) == nil {
+			errs <- resp.Code
+		}
+	}))
+	if _, err := offerer.CreateSession(testContext(t), testOffer("session")); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	sendCandidates(t, offerer, 0, MAX_BUFFERED_CANDIDATES+1)
+	select {
+	case code := <-errs:
+		if code != CodeLimitReached {
+			t.Fatalf("got error %s, want %s", code, CodeLimitReached)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("candidate past the cap accepted")
+	}
+
+	answerer, candidates := ts.dialCandidates(t)
+	if _, err := answerer.SendAnswer(testContext(t), testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	expectCandidates(t, candidates, MAX_BUFFERED_CANDIDATES)
+}
+
+// A candidate buffered right after the peer flushed is not left behind.
+func TestCandidatePushedAfterFlush(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	offerer, _ := ts.offer(t, "session")
+	answerer, candidates := ts.dialCandidates(t)
+	if _, err := answerer.SendAnswer(testContext(t), testAnswer("session")); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+
+	// The answerer is not ready yet when the candidate arrives, and becomes
+	// ready and flushes before the candidate lands in the buffer.
+	store.Del(readyKey("session", hub.Answerer))
+	store.before(candidatesKey("session", hub.Answerer), func() {
+		store.Set(readyKey("session", hub.Answerer), "1", 60)
+		ts.drainCandidates("session", hub.Answerer)
+	})
+
+	sendCandidates(t, offerer, 0, 1)
+	expectCandidates(t, candidates, 1)
+}
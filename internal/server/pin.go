@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+var ErrPINLocked = &SessionError{Code: CodePINLocked, Message: "Too many PIN attempts, the session is locked"}
+
+var ErrPINExpired = &SessionError{Code: CodePINExpired, Message: "The PIN expired, answer the session again"}
+
+// Rejects the request early when either the session or the client IP
+// already used up its PIN attempts. Fails closed, a PIN is never checked
+// while the attempts cannot be read. The lockout itself is decided by
+// `checkPIN`.
+func (s *Server) checkPINLockout(sessionId string, clientIP string) error {
+	sessionAttempts, err := s.pinAttempts(sessionAttemptsKey(sessionId))
+	if err != nil {
+		return err
+	}
+	if sessionAttempts >= s.config.PINMaxAttempts {
+		return ErrPINLocked
+	}
+
+	ipAttempts, err := s.pinAttempts(ipAttemptsKey(clientIP))
+	if err != nil {
+		return err
+	}
+	if ipAttempts >= s.config.PINMaxAttemptsPerIP {
+		return ErrPINLocked
+	}
+	return nil
+}
+
+// Checks the PIN given for a session against the stored one. The attempt
+// is counted against the session and the client IP before comparing, and
+// the lockout is decided from the counts the store returns, so concurrent
+// guesses cannot get past the limits. A right PIN counts too, it confirms
+// the session anyway. The session is invalidated once it runs out of
+// attempts so the PIN cannot be enumerated.
+func (s *Server) checkPIN(sessionId string, clientIP string, pin string) error {
+	stored, err := s.store.Get(pinKey(sessionId))
+	if errors.Is(err, cache.ErrKeyNotFound) {
+		return ErrPINExpired
+	}
+	if err != nil {
+		log.Println("Cannot read the PIN:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+
+	sessionAttempts, err := s.store.Incr(sessionAttemptsKey(sessionId), int(s.config.PINTTL.Seconds()))
+	if err != nil {
+		log.Println("Cannot count the PIN attempt:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+	lockout := int(s.config.PINLockoutDuration.Seconds())
+	ipAttempts, err := s.store.Incr(ipAttemptsKey(clientIP), lockout)
+	if err != nil {
+		log.Println("Cannot count the PIN attempt:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+	if sessionAttempts > int64(s.config.PINMaxAttempts) || ipAttempts > int64(s.config.PINMaxAttemptsPerIP) {
+		return ErrPINLocked
+	}
+	if stored == pin {
+		return nil
+	}
+
+	if sessionAttempts == int64(s.config.PINMaxAttempts) {
+		log.Printf("Session locked after %d wrong PINs\n", sessionAttempts)
+		s.closeSession(sessionId, ReasonPINLocked, hub.Offerer, hub.Answerer)
+		return ErrPINLocked
+	}
+	if ipAttempts == int64(s.config.PINMaxAttemptsPerIP) {
+		log.Printf("Client %s locked after %d wrong PINs\n", clientIP, ipAttempts)
+		return ErrPINLocked
+	}
+	return fmt.Errorf("Invalid PIN")
+}
+
+// Generates the PIN of an answer and stores it for the session.
+func (s *Server) reservePIN(record *session.Record) (string, error) {
+	pin, err := s.pins.GeneratePIN()
+	if err != nil {
+		return "", fmt.Errorf("Cannot generate PIN")
+	}
+	if err := s.store.Set(pinKey(record.Id), pin, s.pinTTL(record)); err != nil {
+		s.releasePIN(record.Id, pin)
+		return "", fmt.Errorf("Cannot save the PIN")
+	}
+	return pin, nil
+}
+
+// Undoes `reservePIN` for an answer that could not be stored. The stored
+// PIN is only deleted while it is still the one reserved.
+func (s *Server) releasePIN(sessionId string, pin string) {
+	if _, err := s.store.CompareAndDelete(pinKey(sessionId), pin); err != nil {
+		log.Println("Cannot delete the PIN:", err)
+	}
+	if err := s.pins.RemovePIN(pin); err != nil {
+		log.Println("Cannot release the PIN:", err)
+	}
+}
+
+// Deletes the PIN of a confirmed session. It is single use because only
+// one request can move the session to confirmed, see `session.Records`.
+func (s *Server) consumePIN(sessionId string) {
+	pin, err := s.store.GetDel(pinKey(sessionId))
+	if err != nil {
+		log.Println("Cannot delete the PIN:", err)
+		return
+	}
+	if err := s.pins.RemovePIN(pin); err != nil {
+		log.Println("Cannot release the PIN:", err)
+	}
+}
+
+func (s *Server) pinAttempts(key string) (int, error) {
+	value, err := s.store.Get(key)
+	if errors.Is(err, cache.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		log.Println("Cannot read the PIN attempts:", err)
+		return 0, fmt.Errorf("A server error ocurred")
+	}
+
+	attempts, err := strconv.Atoi(value)
+	if err != nil {
+		log.Println("Cannot read the PIN attempts:", err)
+		return 0, fmt.Errorf("A server error ocurred")
+	}
+	return attempts, nil
+}
+
+func pinKey(sessionId string) string {
+	return utils.StoreKey("pin", sessionId)
+}
+
+func sessionAttemptsKey(sessionId string) string {
+	return utils.StoreKey("pin-attempts", sessionId)
+}
+
+func ipAttemptsKey(clientIP string) string {
+	return utils.StoreKey("pin-attempts-ip", clientIP)
+}
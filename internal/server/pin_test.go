@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+func TestPINLockoutPerSession(t *testing.T) {
+	ts := newTestServer(t)
+	offerer, _ := ts.offer(t, "session")
+	pin := ts.answer(t, "session")
+	ctx := testContext(t)
+
+	for i := 1; i < ts.config.PINMaxAttempts; i++ {
+		if _, err := offerer.FetchAnswer(ctx, "session", wrongPIN(pin)); !errors.Is(err, signaling.ErrInvalidPIN) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidPIN", i, err)
+		}
+	}
+	if _, err := offerer.FetchAnswer(ctx, "session", wrongPIN(pin)); !errors.Is(err, signaling.ErrPINLocked) {
+		t.Fatalf("last attempt: got %v, want ErrPINLocked", err)
+	}
+
+	// The session is invalidated, the right PIN does not help anymore.
+	other := ts.dial(t)
+	if _, err := other.FetchAnswer(ctx, "session", pin); !errors.Is(err, signaling.ErrPINLocked) {
+		t.Fatalf("right PIN after lockout: got %v, want ErrPINLocked", err)
+	}
+}
+
+func TestPINLockoutPerIP(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.PINMaxAttemptsPerIP = 3
+	})
+	ctx := testContext(t)
+
+	// Guessing across sessions still counts against the client IP.
+	pins := map[string]string{}
+	for _, sessionId := range []string{"first", "second", "third", "fourth"} {
+		ts.offer(t, sessionId)
+		pins[sessionId] = ts.answer(t, sessionId)
+	}
+	attacker := ts.dial(t)
+	for _, sessionId := range []string{"first", "second"} {
+		if _, err := attacker.FetchAnswer(ctx, sessionId, wrongPIN(pins[sessionId])); !errors.Is(err, signaling.ErrInvalidPIN) {
+			t.Fatalf("%s: got %v, want ErrInvalidPIN", sessionId, err)
+		}
+	}
+	if _, err := attacker.FetchAnswer(ctx, "third", wrongPIN(pins["third"])); !errors.Is(err, signaling.ErrPINLocked) {
+		t.Fatalf("third: got %v, want ErrPINLocked", err)
+	}
+	if _, err := attacker.FetchAnswer(ctx, "fourth", pins["fourth"]); !errors.Is(err, signaling.ErrPINLocked) {
+		t.Fatalf("right PIN after lockout: got %v, want ErrPINLocked", err)
+	}
+}
+
+func TestPINSingleUse(t *testing.T) {
+	ts := newTestServer(t)
+	offerer, _ := ts.offer(t, "session")
+	pin := ts.answer(t, "session")
+	ctx := testContext(t)
+
+	answer, err := offerer.FetchAnswer(ctx, "session", pin)
+	if err != nil {
+		t.Fatalf("fetch answer: %v", err)
+	}
+	if answer.AnswerSDP != testAnswer("session").AnswerSDP {
+		t.Fatalf("got answer %q", answer.AnswerSDP)
+	}
+	if _, err := offerer.FetchAnswer(ctx, "session", pin); !errors.Is(err, signaling.ErrSessionDone) {
+		t.Fatalf("second fetch: got %v, want ErrSessionDone", err)
+	}
+}
+
+// A fetch that loses the race for the session record is told to retry, so
+// the PIN has to survive it.
+func TestPINKeptOnConflict(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	offerer, _ := ts.offer(t, "session")
+	pin := ts.answer(t, "session")
+	ctx := testContext(t)
+
+	store.before("session", func() {
+		record, err := ts.sessions.Load("session")
+		if err != nil {
+			t.Errorf("load: %v", err)
+			return
+		}
+		record.ExpiresAt = record.ExpiresAt.Add(time.Minute)
+		if err := ts.sessions.Save(record); err != nil {
+			t.Errorf("concurrent save: %v", err)
+		}
+	})
+	if _, err := offerer.FetchAnswer(ctx, "session", pin); !errors.Is(err, signaling.ErrConflict) {
+		t.Fatalf("got %v, want ErrConflict", err)
+	}
+
+	if _, err := offerer.FetchAnswer(ctx, "session", pin); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if _, err := ts.store.Get(pinKey("session")); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Fatalf("PIN kept after confirmation: %v", err)
+	}
+}
+
+// An expired PIN is reported as such and is not counted as a wrong guess.
+func TestPINExpired(t *testing.T) {
+	ts := newTestServer(t)
+	offerer, _ := ts.offer(t, "session")
+	ts.answer(t, "session")
+	ts.store.Del(pinKey("session"))
+
+	if _, err := offerer.FetchAnswer(testContext(t), "session", "000000"); !errors.Is(err, signaling.ErrPINExpired) {
+		t.Fatalf("got %v, want ErrPINExpired", err)
+	}
+	if attempts, err := ts.pinAttempts(sessionAttemptsKey("session")); err != nil || attempts != 0 {
+		t.Fatalf("expired PIN counted as %d attempts (%v)", attempts, err)
+	}
+}
+
+// A guess that lands while another one is checked counts before the PIN
+// is compared, the right PIN must not get past the limit.
+func TestPINLockoutConcurrentGuess(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	offerer, _ := ts.offer(t, "session")
+	pin := ts.answer(t, "session")
+
+	key := sessionAttemptsKey("session")
+	for i := 1; i < ts.config.PINMaxAttempts; i++ {
+		store.Store.Incr(key, 60)
+	}
+	store.afterAccess(key, func() {
+		store.Store.Incr(key, 60)
+	})
+	if _, err := offerer.FetchAnswer(testContext(t), "session", pin); !errors.Is(err, signaling.ErrPINLocked) {
+		t.Fatalf("right PIN past the limit: got %v, want ErrPINLocked", err)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+var ErrInvalidResumeToken = &SessionError{Code: CodeInvalidToken, Message: "Invalid resume token"}
+
+// Records the connection acting as the role and hands it a new resume
+// token.
+func (s *Server) attachPeer(record *session.Record, role hub.Role, client *hub.Client) (string, error) {
+	resumeToken := utils.GetRandomId()
+	if err := s.store.Set(peerKey(record.Id, role), client.Id(), keyTTL(record)); err != nil {
+		log.Println("Cannot save the peer connection:", err)
+		return "", fmt.Errorf("A server error ocurred")
+	}
+	if err := s.store.Set(resumeKey(record.Id, role), resumeToken, keyTTL(record)); err != nil {
+		log.Println("Cannot save the resume token:", err)
+		return "", fmt.Errorf("A server error ocurred")
+	}
+	return resumeToken, nil
+}
+
+// Reattaches a new connection to the session of the peer the token was
+// issued to. The old connection may still be registered, e.g. when its
+// drop was not noticed yet, and is replaced.
+func (s *Server) handleResume(msg ResumeRequest, client *hub.Client) (*ResumeResponse, error) {
+	record, err := s.loadSession(msg.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	if record.Terminal() {
+		return nil, stateError(record.State)
+	}
+
+	role, ok := s.resumeRole(msg.SessionId, msg.ResumeToken)
+	if !ok {
+		return nil, ErrInvalidResumeToken
+	}
+	resumeToken, err := s.attachPeer(record, role, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResumeResponse{
+		SessionId:   msg.SessionId,
+		Role:        role,
+		State:       record.State,
+		ResumeToken: resumeToken,
+	}, nil
+}
+
+func (s *Server) resumeRole(sessionId string, resumeToken string) (hub.Role, bool) {
+	for _, role := range []hub.Role{hub.Offerer, hub.Answerer} {
+		issued, err := s.store.Get(resumeKey(sessionId, role))
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(issued), []byte(resumeToken)) == 1 {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// Called by the hub when a peer connection drops while in a session. A
+// peer holding a resume token gets `ResumeGracePeriod` to come back before
+// the session is closed, any other peer closes it right away.
+func (s *Server) peerLeft(client *hub.Client, sessionId string, role hub.Role) {
+	// The server is restarting, the session lives on in the store and the
+	// peer can resume it on another instance.
+	if s.hub.Stopping() {
+		s.markAway(client, sessionId, role)
+		return
+	}
+	if roomId, ok := splitRoomHubId(sessionId); ok {
+		memberId, _ := role.MemberId()
+		s.leaveRoom(roomId, memberId)
+		return
+	}
+	if receiverId, ok := role.ReceiverId(); ok {
+		s.closeReceiver(sessionId, receiverId, ReasonDisconnected)
+		return
+	}
+	if _, err := s.store.Get(resumeKey(sessionId, role)); err != nil {
+		s.closeSession(sessionId, ReasonDisconnected, otherRole(role))
+		return
+	}
+	if !s.markAway(client, sessionId, role) {
+		return
+	}
+
+	time.AfterFunc(s.config.ResumeGracePeriod, func() {
+		if s.isAttached(client, sessionId, role) {
+			s.closeSession(sessionId, ReasonDisconnected, otherRole(role))
+		}
+	})
+}
+
+// Candidates relayed while the peer is away would be lost, so they are
+// buffered until it resumes. Reports false when another connection took
+// over the role in the meantime.
+func (s *Server) markAway(client *hub.Client, sessionId string, role hub.Role) bool {
+	if !s.isAttached(client, sessionId, role) {
+		return false
+	}
+	if err := s.store.Del(readyKey(sessionId, role)); err != nil {
+		log.Println("Cannot mark the peer as away:", err)
+	}
+	return true
+}
+
+// Reports whether the connection still acts as the role, i.e. the peer did
+// not resume from another one.
+func (s *Server) isAttached(client *hub.Client, sessionId string, role hub.Role) bool {
+	current, err := s.store.Get(peerKey(sessionId, role))
+	return err == nil && current == client.Id()
+}
+
+// Holds the id of the connection currently acting as the role.
+func peerKey(sessionId string, role hub.Role) string {
+	return utils.StoreKey("peer", sessionId, string(role))
+}
+
+func resumeKey(sessionId string, role hub.Role) string {
+	return utils.StoreKey("resume", sessionId, string(role))
+}
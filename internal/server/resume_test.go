@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+func TestResumeRotatesToken(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer, token := ts.offer(t, "session")
+	offerer.Close()
+
+	resumed, err := ts.dial(t).Resume(ctx, "session", token)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if resumed.Role != "offerer" || resumed.State != "offered" {
+		t.Fatalf("resumed as %s in state %s", resumed.Role, resumed.State)
+	}
+	if resumed.ResumeToken == "" || resumed.ResumeToken == token {
+		t.Fatal("resume token not rotated")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"used token", token},
+		{"unknown token", "unknown"},
+		{"empty token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ts.dial(t).Resume(ctx, "session", tt.token); !errors.Is(err, signaling.ErrInvalidToken) {
+				t.Fatalf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+
+	if _, err := ts.dial(t).Resume(ctx, "missing", resumed.ResumeToken); !errors.Is(err, signaling.ErrSessionNotFound) {
+		t.Fatalf("unknown session: got %v, want ErrSessionNotFound", err)
+	}
+}
+
+// An answer that arrives while the offerer is away is not lost, the
+// offerer picks it up after resuming.
+func TestResumeAfterAnswer(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer, token := ts.offer(t, "session")
+	offerer.Close()
+
+	pin := ts.answer(t, "session")
+
+	offerer = ts.dial(t)
+	resumed, err := offerer.Resume(ctx, "session", token)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if resumed.State != "answered" {
+		t.Fatalf("state is %s, want answered", resumed.State)
+	}
+	if err := offerer.AwaitConfirmation(ctx); err != nil {
+		t.Fatalf("await confirmation: %v", err)
+	}
+	if _, err := offerer.FetchAnswer(ctx, "session", pin); err != nil {
+		t.Fatalf("fetch answer: %v", err)
+	}
+}
+
+func TestResumeClosedSession(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer, token := ts.offer(t, "session")
+	if err := offerer.CancelSession(ctx, "session"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	if _, err := ts.dial(t).Resume(ctx, "session", token); !errors.Is(err, signaling.ErrSessionClosed) {
+		t.Fatalf("got %v, want ErrSessionClosed", err)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/utils"
+)
+
+// Rooms let any number of members exchange offers, answers and candidates
+// pairwise over the session socket. Unlike sessions they have no record and
+// no PINs, a room exists while it has members.
+//
+// Every member has a key of its own holding the id of its connection,
+// which the connection refreshes well within `settings.RoomMemberTTL`. The
+// membership list only indexes those keys, members whose key expired are
+// skipped and dropped from it on the next change.
+//
+// Members take the role `hub.MemberRole(memberId)` in a hub session named
+// `room/<roomId>`. Session ids never contain the separator, so the two
+// cannot collide.
+const (
+	ROOM_PREFIX = "room" + RECEIVER_SEPARATOR
+
+	// The membership list is rewritten under a lock so that concurrent
+	// joins on different instances do not drop each other. The lock holds
+	// a random token and is only released by its holder.
+	ROOM_LOCK_TTL     = 5
+	ROOM_LOCK_TIMEOUT = 2 * time.Second
+	ROOM_LOCK_RETRY   = 10 * time.Millisecond
+)
+
+var (
+	ErrRoomFull      = &SessionError{Code: CodeLimitReached, Message: "Room is full"}
+	ErrMemberTaken   = errors.New("Member id already taken")
+	ErrNotRoomMember = errors.New("Not a member of this room")
+)
+
+// Adds the client to the room under the member id it asked for and lets
+// the other members know.
+func (s *Server) handleJoinRoom(msg RoomRequest, client *hub.Client) (*RoomResponse, error) {
+	if !utils.ValidId(msg.RoomId) || !utils.ValidId(msg.MemberId) {
+		return nil, fmt.Errorf("Invalid room or member id")
+	}
+
+	var members []string
+	err := s.updateMembers(msg.RoomId, func(current []string) ([]string, error) {
+		if slices.Contains(current, msg.MemberId) {
+			return nil, ErrMemberTaken
+		}
+		if len(current) >= s.config.RoomMaxMembers {
+			return nil, ErrRoomFull
+		}
+		if err := s.store.Set(memberKey(msg.RoomId, msg.MemberId), client.Id(), s.memberTTL()); err != nil {
+			log.Println("Cannot add the room member:", err)
+			return nil, fmt.Errorf("A server error ocurred")
+		}
+		members = append(current, msg.MemberId)
+		return members, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.keepMemberAlive(msg.RoomId, msg.MemberId, client)
+	s.hub.AddSession(client, roomHubId(msg.RoomId), hub.MemberRole(msg.MemberId))
+	s.sendToRoom(msg.RoomId, msg.MemberId, MemberJoined, MemberPayload{RoomId: msg.RoomId, MemberId: msg.MemberId})
+
+	return &RoomResponse{RoomId: msg.RoomId, MemberId: msg.MemberId, Members: members}, nil
+}
+
+func (s *Server) handleLeaveRoom(msg RoomRequest, client *hub.Client) (*RoomResponse, error) {
+	memberId, err := s.roomMember(msg.RoomId, client)
+	if err != nil {
+		return nil, err
+	}
+
+	s.hub.LeaveSession(client, roomHubId(msg.RoomId))
+	s.leaveRoom(msg.RoomId, memberId)
+
+	return &RoomResponse{RoomId: msg.RoomId, MemberId: memberId}, nil
+}
+
+func (s *Server) handleListMembers(msg RoomRequest, client *hub.Client) (*RoomResponse, error) {
+	memberId, err := s.roomMember(msg.RoomId, client)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.roomMembers(msg.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomResponse{RoomId: msg.RoomId, MemberId: memberId, Members: members}, nil
+}
+
+// Relays an offer, answer or candidate to another member of the room.
+func (s *Server) handleRoomSignal(msgType SessionMessageType, msg RoomSignal, client *hub.Client) (*AckResponse, error) {
+	memberId, err := s.roomMember(msg.RoomId, client)
+	if err != nil {
+		return nil, err
+	}
+	if msg.To == memberId {
+		return nil, fmt.Errorf("Cannot signal yourself")
+	}
+
+	members, err := s.roomMembers(msg.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(members, msg.To) {
+		return nil, fmt.Errorf("Member not found")
+	}
+
+	msg.From = memberId
+	s.sendToRole(roomHubId(msg.RoomId), hub.MemberRole(msg.To), msgType, msg, false)
+
+	return &AckResponse{Message: "Ok"}, nil
+}
+
+// Removes the member from the room and lets the others know. Called when
+// a member leaves and when its connection drops.
+func (s *Server) leaveRoom(roomId string, memberId string) {
+	s.stopMemberRefresh(roomId, memberId)
+	if err := s.store.Del(memberKey(roomId, memberId)); err != nil {
+		log.Println("Cannot remove the room member:", err)
+	}
+
+	err := s.updateMembers(roomId, func(current []string) ([]string, error) {
+		return slices.DeleteFunc(current, func(member string) bool {
+			return member == memberId
+		}), nil
+	})
+	if err != nil {
+		log.Println("Cannot remove the room member:", err)
+	}
+
+	s.sendToRoom(roomId, memberId, MemberLeft, MemberPayload{RoomId: roomId, MemberId: memberId})
+}
+
+// Returns the member id the client joined the room with.
+func (s *Server) roomMember(roomId string, client *hub.Client) (string, error) {
+	role, ok := s.hub.GetRole(client, roomHubId(roomId))
+	if !ok {
+		return "", ErrNotRoomMember
+	}
+	memberId, _ := role.MemberId()
+	return memberId, nil
+}
+
+// Members of the room that are still alive.
+func (s *Server) roomMembers(roomId string) ([]string, error) {
+	members, err := s.indexedMembers(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	alive := members[:0]
+	for _, memberId := range members {
+		_, err := s.store.Get(memberKey(roomId, memberId))
+		if errors.Is(err, cache.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Println("Cannot read the room member:", err)
+			return nil, fmt.Errorf("A server error ocurred")
+		}
+		alive = append(alive, memberId)
+	}
+	return alive, nil
+}
+
+// Members listed in the membership index, alive or not.
+func (s *Server) indexedMembers(roomId string) ([]string, error) {
+	membersRaw, err := s.store.Get(roomMembersKey(roomId))
+	if errors.Is(err, cache.ErrKeyNotFound) {
+		return []string{}, nil
+	}
+	if err != nil {
+		log.Println("Cannot read the room members:", err)
+		return nil, fmt.Errorf("A server error ocurred")
+	}
+
+	var members []string
+	if err := json.Unmarshal([]byte(membersRaw), &members); err != nil {
+		log.Println("Cannot decode the room members:", err)
+		return nil, fmt.Errorf("A server error ocurred")
+	}
+	return members, nil
+}
+
+// Rewrites the membership list with the result of `fn` while holding the
+// room lock. `fn` is given the members that are still alive. An empty list
+// removes the room.
+func (s *Server) updateMembers(roomId string, fn func(current []string) ([]string, error)) error {
+	lockKey := roomLockKey(roomId)
+	token := utils.GetRandomId()
+	deadline := time.Now().Add(ROOM_LOCK_TIMEOUT)
+	for {
+		locked, err := s.store.SetNX(lockKey, token, ROOM_LOCK_TTL)
+		if err != nil {
+			log.Println("Cannot lock the room:", err)
+			return fmt.Errorf("A server error ocurred")
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Room is busy, try again")
+		}
+		time.Sleep(ROOM_LOCK_RETRY)
+	}
+	// The lock may have expired and been taken by someone else, only our
+	// own token is released.
+	defer func() {
+		if _, err := s.store.CompareAndDelete(lockKey, token); err != nil {
+			log.Println("Cannot unlock the room:", err)
+		}
+	}()
+
+	current, err := s.roomMembers(roomId)
+	if err != nil {
+		return err
+	}
+	members, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return s.store.Del(roomMembersKey(roomId))
+	}
+	membersRaw, _ := json.Marshal(members)
+	return s.store.Set(roomMembersKey(roomId), membersRaw, int(s.config.RoomTTL.Seconds()))
+}
+
+// Refreshes the member key until the member leaves or its connection
+// goes away.
+func (s *Server) keepMemberAlive(roomId string, memberId string, client *hub.Client) {
+	key := memberKey(roomId, memberId)
+	stop := make(chan struct{})
+	if previous, loaded := s.memberRefresh.Swap(key, stop); loaded {
+		close(previous.(chan struct{}))
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.config.RoomMemberTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.store.Set(key, client.Id(), s.memberTTL()); err != nil {
+					log.Println("Cannot refresh the room member:", err)
+				}
+			case <-stop:
+				return
+			case <-client.Finished():
+				s.memberRefresh.CompareAndDelete(key, stop)
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) stopMemberRefresh(roomId string, memberId string) {
+	if stop, loaded := s.memberRefresh.LoadAndDelete(memberKey(roomId, memberId)); loaded {
+		close(stop.(chan struct{}))
+	}
+}
+
+func (s *Server) memberTTL() int {
+	return int(s.config.RoomMemberTTL.Seconds())
+}
+
+// Sends a message to every member of the room but `except`.
+func (s *Server) sendToRoom(roomId string, except string, msgType SessionMessageType, payload any) {
+	payloadRaw, _ := json.Marshal(payload)
+	rawMessage, _ := json.Marshal(SessionMessage{Type: msgType, Payload: payloadRaw})
+	if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+		SessionId: roomHubId(roomId),
+		Except:    hub.MemberRole(except),
+		Message:   rawMessage,
+	}); err != nil {
+		log.Println("Cannot notify the room:", err)
+	}
+}
+
+func roomHubId(roomId string) string {
+	return ROOM_PREFIX + roomId
+}
+
+func splitRoomHubId(sessionId string) (string, bool) {
+	return strings.CutPrefix(sessionId, ROOM_PREFIX)
+}
+
+func roomMembersKey(roomId string) string {
+	return utils.StoreKey("room-members", roomId)
+}
+
+func roomLockKey(roomId string) string {
+	return utils.StoreKey("room-lock", roomId)
+}
+
+func memberKey(roomId string, memberId string) string {
+	return utils.StoreKey("room-member", roomId, memberId)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+func joinRoom(t *testing.T, client *signaling.Client, memberId string) []string {
+	t.Helper()
+
+	members, err := client.JoinRoom(testContext(t), "room", memberId)
+	if err != nil {
+		t.Fatalf("join as %s: %v", memberId, err)
+	}
+	return members
+}
+
+func TestRoomJoinLeave(t *testing.T) {
+	ts := newTestServer(t, func(config *settings.Settings) {
+		config.RoomMaxMembers = 2
+	})
+	ctx := testContext(t)
+	first, events := ts.dialEvents(t)
+	second := ts.dial(t)
+
+	joinRoom(t, first, "first")
+	if members := joinRoom(t, second, "second"); !slices.Equal(members, []string{"first", "second"}) {
+		t.Fatalf("members %v, want [first second]", members)
+	}
+	expectEvent(t, events, signaling.TypeMemberJoined)
+
+	if _, err := ts.dial(t).JoinRoom(ctx, "room", "third"); !errors.Is(err, signaling.ErrLimitReached) {
+		t.Fatalf("join past the limit: got %v, want ErrLimitReached", err)
+	}
+
+	if err := second.LeaveRoom(ctx, "room"); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	expectEvent(t, events, signaling.TypeMemberLeft)
+	members, err := first.ListMembers(ctx, "room")
+	if err != nil {
+		t.Fatalf("list members: %v", err)
+	}
+	if !slices.Equal(members, []string{"first"}) {
+		t.Fatalf("members %v, want [first]", members)
+	}
+
+	// The member id is free again once its member left.
+	joinRoom(t, ts.dial(t), "second")
+}
+
+func TestRoomMemberTaken(t *testing.T) {
+	ts := newTestServer(t)
+	joinRoom(t, ts.dial(t), "member")
+
+	if _, err := ts.dial(t).JoinRoom(testContext(t), "room", "member"); err == nil {
+		t.Fatal("member id joined twice")
+	}
+}
+
+func TestRoomMemberDisconnects(t *testing.T) {
+	ts := newTestServer(t)
+	first, events := ts.dialEvents(t)
+	second := ts.dial(t)
+	joinRoom(t, first, "first")
+	joinRoom(t, second, "second")
+
+	second.Close()
+	expectEvent(t, events, signaling.TypeMemberLeft)
+}
+
+func TestRoomSignalRelayed(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	signals := make(chan signaling.Message, 1)
+	first := ts.dial(t)
+	second := ts.dial(t, signaling.WithEventHandler(func(msg signaling.Message) {
+		if msg.Type == signaling.TypeRoomOffer {
+			signals <- msg
+		}
+	}))
+	joinRoom(t, first, "first")
+	joinRoom(t, second, "second")
+
+	if err := first.SendRoomSignal(ctx, signaling.TypeRoomOffer, signaling.RoomSignal{RoomId: "room", To: "missing", OfferSDP: "b2ZmZXI="}); err == nil {
+		t.Fatal("signal to a missing member accepted")
+	}
+	if err := first.SendRoomSignal(ctx, signaling.TypeRoomOffer, signaling.RoomSignal{RoomId: "room", To: "second", OfferSDP: "b2ZmZXI="}); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	select {
+	case <-signals:
+	case <-ctx.Done():
+		t.Fatal("offer not relayed")
+	}
+}
+
+// The room lock may expire while held and be taken by another request,
+// whose lock must then survive the release of the first one.
+func TestRoomLockReleasedByHolderOnly(t *testing.T) {
+	store := newHookedStore()
+	ts := newTestServerWithStore(t, store)
+	joinRoom(t, ts.dial(t), "first")
+	if _, err := store.Store.Get(roomLockKey("room")); !errors.Is(err, cache.ErrKeyNotFound) {
+		t.Fatalf("lock kept after join: %v", err)
+	}
+
+	store.afterAccess(roomMembersKey("room"), func() {
+		store.Store.Set(roomLockKey("room"), "other", ROOM_LOCK_TTL)
+	})
+	joinRoom(t, ts.dial(t), "second")
+
+	if token, err := store.Store.Get(roomLockKey("room")); err != nil || token != "other" {
+		t.Fatalf("lock of another holder released: %q, %v", token, err)
+	}
+}
@@ -3,6 +3,10 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
 )
 
 type SessionMessageType string
@@ -15,8 +19,62 @@ const (
 	Ok                SessionMessageType = "ok"
 	GetAnswer         SessionMessageType = "get_answer"
 	ConfirmConnection SessionMessageType = "confirm_connection"
+	IceCandidate      SessionMessageType = "ice_candidate"
+	EndOfCandidates   SessionMessageType = "end_of_candidates"
+	AnswerRejected    SessionMessageType = "answer_rejected"
+	CancelSession     SessionMessageType = "cancel_session"
+	SessionClosed     SessionMessageType = "session_closed"
+	ExtendSession     SessionMessageType = "extend_session"
+	SessionExpiring   SessionMessageType = "session_expiring"
+	SessionExpired    SessionMessageType = "session_expired"
+	SessionExtended   SessionMessageType = "session_extended"
+	Resume            SessionMessageType = "resume"
+	Join              SessionMessageType = "join"
+	ReceiverJoined    SessionMessageType = "receiver_joined"
+	ListReceivers     SessionMessageType = "list_receivers"
+	ApproveReceiver   SessionMessageType = "approve_receiver"
+	ReceiverApproved  SessionMessageType = "receiver_approved"
+	ReceiverLeft      SessionMessageType = "receiver_left"
+	JoinRoom          SessionMessageType = "join_room"
+	LeaveRoom         SessionMessageType = "leave_room"
+	ListMembers       SessionMessageType = "list_members"
+	MemberJoined      SessionMessageType = "member_joined"
+	MemberLeft        SessionMessageType = "member_left"
+	RoomOffer         SessionMessageType = "room_offer"
+	RoomAnswer        SessionMessageType = "room_answer"
+	RoomIceCandidate  SessionMessageType = "room_ice_candidate"
+	Hello             SessionMessageType = "hello"
 )
 
+// Machine readable reason attached to some `error` messages so clients can
+// react to them without matching on the text.
+type ErrorCode string
+
+const (
+	CodePINLocked       ErrorCode = "pin_locked"
+	CodePINExpired      ErrorCode = "pin_expired"
+	CodeSessionClosed   ErrorCode = "session_closed"
+	CodeSessionExpired  ErrorCode = "session_expired"
+	CodeInvalidState    ErrorCode = "invalid_state"
+	CodeBadSignature    ErrorCode = "invalid_signature"
+	CodeReplayed        ErrorCode = "replayed"
+	CodeLimitReached    ErrorCode = "limit_reached"
+	CodeInvalidToken    ErrorCode = "invalid_resume_token"
+	CodeUnsupported     ErrorCode = "unsupported_version"
+	CodeConflict        ErrorCode = "conflict"
+	CodeFeatureRequired ErrorCode = "feature_not_negotiated"
+)
+
+// SessionError is a client facing error carrying an `ErrorCode`.
+type SessionError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *SessionError) Error() string {
+	return e.Message
+}
+
 type ActionParameter string
 
 const (
@@ -38,37 +96,71 @@ func GetActionParameter(value string) (ActionParameter, error) {
 type SessionMessage struct {
 	Payload json.RawMessage    `json:"payload"`
 	Type    SessionMessageType `json:"type"`
+	// Set on `ok` and `error` replies to the type of the message they
+	// answer, so a client can tell the error for a relayed candidate apart
+	// from the reply to its pending request.
+	ReplyTo SessionMessageType `json:"replyTo,omitempty"`
 }
 
 type OfferRequest struct {
 	SessionId string `json:"sessionId"`
 	OfferSDP  string `json:"offerSDP"`
 	PubKey    string `json:"pubKey"`
-	Timestamp string `json:"timestamp"`
+	// Public key the signature is made with, in the same encoding as
+	// `pubKey`. It must differ from `pubKey`, which is only used for ECDH.
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature,omitempty"`
+	// Requested session lifetime in seconds, `SessionTTL` when omitted.
+	TTL int `json:"ttl,omitempty"`
+	// Turns the session into a broadcast session with up to this many
+	// receivers.
+	MaxReceivers int `json:"maxReceivers,omitempty"`
+	// Set by `approve_receiver`, the offer is meant for this receiver only.
+	ReceiverId string `json:"receiverId,omitempty"`
 }
 
 type OfferResponse struct {
 	Message string `json:"message"`
+	// Lets the offerer reattach to the session with `resume` after its
+	// connection dropped.
+	ResumeToken string `json:"resumeToken,omitempty"`
 }
 
-type ErrorResponse struct {
+// Reply to requests that have nothing to report beyond their success,
+// such as `cancel_session`.
+type AckResponse struct {
 	Message string `json:"message"`
 }
 
+type ErrorResponse struct {
+	Message string    `json:"message"`
+	Code    ErrorCode `json:"code,omitempty"`
+}
+
 type SessionRequest struct {
 	SessionId string `json:"sessionId"`
 }
 
+// Offer handed to the answerer. The signature fields are forwarded as the
+// offerer sent them so the answerer can verify the offer and compare the
+// fingerprint of the signing key out of band.
 type SessionResponse struct {
-	OfferSDP string `json:"offerSDP"`
-	PubKey   string `json:"pubKey"`
+	OfferSDP   string `json:"offerSDP"`
+	PubKey     string `json:"pubKey"`
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Signature  string `json:"signature,omitempty"`
 }
 
 type AnswerRequest struct {
-	SessionId string `json:"sessionId"`
-	AnswerSDP string `json:"answerSDP"`
-	PubKey    string `json:"pubKey"`
-	Timestamp string `json:"timestamp"`
+	SessionId  string `json:"sessionId"`
+	AnswerSDP  string `json:"answerSDP"`
+	PubKey     string `json:"pubKey"`
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature,omitempty"`
+	ReceiverId string `json:"receiverId,omitempty"`
 }
 
 type AnswerResponse struct {
@@ -77,6 +169,144 @@ type AnswerResponse struct {
 }
 
 type GetAnswerRequest struct {
+	SessionId  string `json:"sessionId"`
+	Pin        string `json:"pin"`
+	ReceiverId string `json:"receiverId,omitempty"`
+}
+
+// Sent to the offerer when someone else tries to answer a session that
+// already has an answerer.
+type AnswerRejectedPayload struct {
 	SessionId string `json:"sessionId"`
-	Pin       string `json:"pin"`
+	Message   string `json:"message"`
+}
+
+// Why a session ended, sent to the remaining peer with `session_closed`.
+type CloseReason string
+
+const (
+	ReasonCancelled    CloseReason = "cancelled"
+	ReasonDisconnected CloseReason = "peer_disconnected"
+	ReasonPINLocked    CloseReason = "pin_locked"
+)
+
+// Sent with `session_closed`, and with `receiver_left` to the offerer of a
+// broadcast session.
+type SessionClosedPayload struct {
+	SessionId  string      `json:"sessionId"`
+	ReceiverId string      `json:"receiverId,omitempty"`
+	Reason     CloseReason `json:"reason"`
+}
+
+// Deadline of a session, sent with `session_expiring`, `session_extended`
+// and as the reply to `extend_session`. `session_expired` only carries the
+// session id.
+type SessionExpiryPayload struct {
+	SessionId string     `json:"sessionId"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type ResumeRequest struct {
+	SessionId   string `json:"sessionId"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// Reply to `resume`. The token is replaced on every use and the state
+// tells the peer which step it missed while it was away.
+type ResumeResponse struct {
+	SessionId   string        `json:"sessionId"`
+	Role        hub.Role      `json:"role"`
+	State       session.State `json:"state"`
+	ResumeToken string        `json:"resumeToken"`
+}
+
+// Receiver of a broadcast session, sent with `receiver_joined`,
+// `confirm_connection` and as the reply to `join` and `list_receivers`.
+type ReceiverPayload struct {
+	SessionId  string        `json:"sessionId,omitempty"`
+	ReceiverId string        `json:"receiverId"`
+	State      session.State `json:"state,omitempty"`
+}
+
+type ReceiversResponse struct {
+	SessionId string            `json:"sessionId"`
+	Receivers []ReceiverPayload `json:"receivers"`
+}
+
+// Offer the offerer made for a single receiver, pushed with
+// `receiver_approved`.
+type ReceiverApprovedPayload struct {
+	SessionId  string `json:"sessionId"`
+	ReceiverId string `json:"receiverId"`
+	OfferSDP   string `json:"offerSDP"`
+	PubKey     string `json:"pubKey"`
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// Trickled ICE candidate relayed to the other peer of the session. The
+// candidate is the `RTCIceCandidateInit` produced by the browser and is
+// omitted for `end_of_candidates`. In broadcast sessions the receiver id
+// tells which receiver the candidate is for or comes from.
+type IceCandidateRequest struct {
+	SessionId  string          `json:"sessionId"`
+	ReceiverId string          `json:"receiverId,omitempty"`
+	Candidate  json.RawMessage `json:"candidate,omitempty"`
+}
+
+type RoomRequest struct {
+	RoomId   string `json:"roomId"`
+	MemberId string `json:"memberId,omitempty"`
+}
+
+// Reply to `join_room` and `list_members`.
+type RoomResponse struct {
+	RoomId   string   `json:"roomId"`
+	MemberId string   `json:"memberId,omitempty"`
+	Members  []string `json:"members"`
+}
+
+// Pushed to the other members with `member_joined` and `member_left`.
+type MemberPayload struct {
+	RoomId   string `json:"roomId"`
+	MemberId string `json:"memberId"`
+}
+
+// Offer, answer or ICE candidate sent by a room member to another one. The
+// server fills in `from` before relaying it to the member named in `to`.
+type RoomSignal struct {
+	RoomId    string          `json:"roomId"`
+	From      string          `json:"from,omitempty"`
+	To        string          `json:"to"`
+	OfferSDP  string          `json:"offerSDP,omitempty"`
+	AnswerSDP string          `json:"answerSDP,omitempty"`
+	PubKey    string          `json:"pubKey,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+}
+
+// Sent by clients as their first message. `version` is the highest
+// protocol version the client speaks.
+type HelloRequest struct {
+	Client   string   `json:"client"`
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// Reply to `hello` with the version both sides use, the features both
+// support and the limits enforced by the server.
+type HelloResponse struct {
+	Version  int            `json:"version"`
+	Features []string       `json:"features"`
+	Limits   ProtocolLimits `json:"limits"`
+}
+
+// Durations are given in seconds and sizes in bytes.
+type ProtocolLimits struct {
+	SessionTTL         int `json:"sessionTTL"`
+	MaxSessionLifetime int `json:"maxSessionLifetime"`
+	PINTTL             int `json:"pinTTL"`
+	MaxMessageSize     int `json:"maxMessageSize"`
+	MaxReceivers       int `json:"maxReceivers"`
+	MaxRoomMembers     int `json:"maxRoomMembers"`
 }
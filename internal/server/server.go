@@ -1,21 +1,70 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
 	brotli "github.com/anargu/gin-brotli"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/vladNed/hyperspace/internal/cache"
 	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
 	"github.com/vladNed/hyperspace/internal/settings"
+	"github.com/vladNed/hyperspace/internal/utils"
 )
 
 type Server struct {
-	engine *gin.Engine
+	engine   *gin.Engine
+	config   *settings.Settings
+	store    cache.Store
+	hub      *hub.Hub
+	pins     utils.PINManager
+	sessions *session.Records
+	upgrader websocket.Upgrader
+	// Member key to the channel that stops refreshing it, see room.go.
+	memberRefresh sync.Map
 }
 
-func NewServer() *Server {
+func NewServer() (*Server, error) {
 	gin.SetMode(gin.ReleaseMode)
-	return &Server{
-		engine: gin.Default(),
+	config := settings.GetInstance()
+	store, err := cache.NewStore(config)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(gin.Default(), config, store), nil
+}
+
+func newServer(engine *gin.Engine, config *settings.Settings, store cache.Store) *Server {
+	server := &Server{
+		engine:   engine,
+		config:   config,
+		store:    store,
+		hub:      hub.NewHub(config, cache.NewBroker(store)),
+		pins:     newPINManager(config, store),
+		sessions: session.NewRecords(store),
+		upgrader: newUpgrader(config),
+	}
+	server.hub.OnLeave(server.peerLeft)
+	server.hub.OnExpiry(server.sessionExpiring, server.sessionExpired)
+
+	return server
+}
+
+// PINs must be unique across every instance sharing redis, a single node
+// keeps them in memory.
+func newPINManager(config *settings.Settings, store cache.Store) utils.PINManager {
+	if config.CacheBackend == cache.RedisBackend {
+		return utils.NewStorePINManager(store, config.PINTTL)
 	}
+	return utils.NewMemoryPINManager(config.PINTTL)
 }
 
 func (s *Server) RegisterRoutes() {
@@ -23,16 +72,28 @@ func (s *Server) RegisterRoutes() {
 	v1.GET("/ping/", pingHandler)
 
 	wsV1 := s.engine.Group("/ws/v1")
-	wsV1.GET("/session/", wsHandler)
+	wsV1.GET("/session/", s.wsHandler)
 
 	s.engine.GET("/", indexHandler)
-	s.engine.GET("/session/:action", connectHandler)
-	s.engine.GET("/session/connect/:sessionId/", sessionCommonHandler)
+	s.engine.GET("/session/:action", s.connectHandler)
+	s.engine.GET("/session/connect/:sessionId/", s.sessionCommonHandler)
 	s.engine.GET("/session/pin/:action/", sessionPinHandler)
-	s.engine.GET("/connect/:sessionId/", connectingHandler)
+	s.engine.GET("/connect/:sessionId/", s.connectingHandler)
+}
+
+// Routes of the internal listener, kept off the public one so the metrics
+// of the instance are not exposed.
+func (s *Server) metricsRouter() *gin.Engine {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	engine.GET("/api/v1/metrics/", s.metricsHandler)
+	return engine
 }
 
-func (s *Server) Run() {
+// Serves until SIGINT or SIGTERM, then stops accepting connections, closes
+// every websocket with a restart notice and waits up to
+// `settings.ShutdownTimeout` for them to drain.
+func (s *Server) Run() error {
 	s.engine.Static("/static", "./web/static")
 	s.engine.Static("/public", "./web/public")
 	s.engine.StaticFile("/sitemap.xml", "./web/public/sitemap.xml")
@@ -40,18 +101,66 @@ func (s *Server) Run() {
 	s.engine.LoadHTMLGlob("./web/pages/**/*")
 
 	s.engine.Use(brotli.Brotli(brotli.DefaultCompression))
-	s.engine.SetTrustedProxies(nil)
+	if err := s.engine.SetTrustedProxies(s.config.TrustedProxies); err != nil {
+		return err
+	}
 
 	s.RegisterRoutes()
 
-	hub := hub.GetInstance()
-	go hub.Run()
+	go s.hub.Run()
 
-	config := settings.GetInstance()
-	if config.Env == "prod" {
+	if s.config.Env == "prod" {
 		gin.SetMode(gin.ReleaseMode)
 	} else {
 		gin.SetMode(gin.DebugMode)
 	}
-	s.engine.Run()
+
+	httpServer := &http.Server{
+		Addr:    ":" + s.config.Port,
+		Handler: s.engine,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []*http.Server{httpServer}
+	if s.config.MetricsAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:    s.config.MetricsAddr,
+			Handler: s.metricsRouter(),
+		})
+	}
+
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			log.Println("Listening on", server.Addr)
+			serveErr <- server.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("ERROR: Cannot shutdown the http server ->>", err)
+		}
+	}
+	if err := s.hub.Shutdown(shutdownCtx); err != nil {
+		log.Println("ERROR: Hub connections did not drain in time ->>", err)
+	}
+	s.pins.Stop()
+
+	return s.store.Close()
 }
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	"github.com/vladNed/hyperspace/internal/utils"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+const testTimeout = 5 * time.Second
+
+// Mirrors the defaults of `settings.loadEnvVars` for a single node backed
+// by the memory store.
+func testConfig() *settings.Settings {
+	return &settings.Settings{
+		CacheBackend:          cache.MemoryBackend,
+		WSPingInterval:        54 * time.Second,
+		WSPongWait:            60 * time.Second,
+		WSWriteWait:           10 * time.Second,
+		WSMaxMessageSize:      64 * 1024,
+		WSSendQueueSize:       256,
+		WSSlowConsumerPolicy:  "disconnect",
+		ShutdownTimeout:       testTimeout,
+		PINMaxAttempts:        5,
+		PINMaxAttemptsPerIP:   20,
+		PINLockoutDuration:    15 * time.Minute,
+		SignatureMaxAge:       time.Minute,
+		SessionTTL:            5 * time.Minute,
+		PINTTL:                5 * time.Minute,
+		SessionExpiryWarning:  time.Minute,
+		SessionMaxLifetime:    30 * time.Minute,
+		ResumeGracePeriod:     30 * time.Second,
+		BroadcastMaxReceivers: 10,
+		RoomMaxMembers:        16,
+		RoomTTL:               24 * time.Hour,
+		RoomMemberTTL:         30 * time.Second,
+	}
+}
+
+type testServer struct {
+	*Server
+	url string
+}
+
+// Serves the websocket routes on a local listener. `configure` adjusts the
+// default test config before the server is built.
+func newTestServer(t *testing.T, configure ...func(*settings.Settings)) *testServer {
+	t.Helper()
+	return newTestServerWithStore(t, cache.NewMemory(), configure...)
+}
+
+func newTestServerWithStore(t *testing.T, store cache.Store, configure ...func(*settings.Settings)) *testServer {
+	t.Helper()
+
+	config := testConfig()
+	for _, fn := range configure {
+		fn(config)
+	}
+
+	gin.SetMode(gin.TestMode)
+	s := newServer(gin.New(), config, store)
+	s.RegisterRoutes()
+	go s.hub.Run()
+
+	httpServer := httptest.NewServer(s.engine)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		httpServer.Close()
+		if err := s.hub.Shutdown(ctx); err != nil {
+			t.Errorf("hub shutdown: %v", err)
+		}
+		s.pins.Stop()
+		s.store.Close()
+	})
+
+	return &testServer{
+		Server: s,
+		url:    "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws/v1/session/",
+	}
+}
+
+// Memory store that runs a hook right before the next compare and swap or
+// push on a key, to make a concurrent request win the race for it.
+type hookedStore struct {
+	cache.Store
+	mutex sync.Mutex
+	hooks map[string]func()
+	// Run right after the next read or expire of a key.
+	accessHooks map[string]func()
+}
+
+func newHookedStore() *hookedStore {
+	return &hookedStore{
+		Store:       cache.NewMemory(),
+		hooks:       make(map[string]func()),
+		accessHooks: make(map[string]func()),
+	}
+}
+
+func (s *hookedStore) before(key string, hook func()) {
+	s.mutex.Lock()
+	s.hooks[key] = hook
+	s.mutex.Unlock()
+}
+
+func (s *hookedStore) afterAccess(key string, hook func()) {
+	s.mutex.Lock()
+	s.accessHooks[key] = hook
+	s.mutex.Unlock()
+}
+
+func (s *hookedStore) runHook(hooks map[string]func(), key string) {
+	s.mutex.Lock()
+	hook := hooks[key]
+	delete(hooks, key)
+	s.mutex.Unlock()
+
+	if hook != nil {
+		hook()
+	}
+}
+
+func (s *hookedStore) Get(key string) (string, error) {
+	value, err := s.Store.Get(key)
+	s.runHook(s.accessHooks, key)
+	return value, err
+}
+
+func (s *hookedStore) Expire(key string, ttl int) (bool, error) {
+	exists, err := s.Store.Expire(key, ttl)
+	s.runHook(s.accessHooks, key)
+	return exists, err
+}
+
+func (s *hookedStore) CompareAndSwap(key string, old string, value any, ttl int) (bool, error) {
+	s.runHook(s.hooks, key)
+	return s.Store.CompareAndSwap(key, old, value, ttl)
+}
+
+func (s *hookedStore) Push(key string, value any, limit int, ttl int) (int64, error) {
+	s.runHook(s.hooks, key)
+	return s.Store.Push(key, value, limit, ttl)
+}
+
+// Dials a client that negotiated every feature with `hello`.
+func (ts *testServer) dial(t *testing.T, opts ...signaling.Option) *signaling.Client {
+	t.Helper()
+
+	client := ts.dialWithoutHello(t, opts...)
+	if _, err := client.Hello(testContext(t), "test"); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	return client
+}
+
+// Opens a signaling connection that is closed with the test.
+func (ts *testServer) dialWithoutHello(t *testing.T, opts ...signaling.Option) *signaling.Client {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client, err := signaling.Dial(ctx, ts.url, opts...)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Creates a session on a new connection and returns the connection along
+// with the resume token of the offerer.
+func (ts *testServer) offer(t *testing.T, sessionId string) (*signaling.Client, string) {
+	t.Helper()
+
+	offerer := ts.dial(t)
+	token, err := offerer.CreateSession(testContext(t), testOffer(sessionId))
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return offerer, token
+}
+
+// Answers the session on a new connection and returns the PIN.
+func (ts *testServer) answer(t *testing.T, sessionId string) string {
+	t.Helper()
+
+	pin, err := ts.dial(t).SendAnswer(testContext(t), testAnswer(sessionId))
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	return pin
+}
+
+// Every test offer and answer carries its own public key so none of them
+// is taken for a replay of another.
+func testOffer(sessionId string) signaling.Offer {
+	return signaling.Offer{SessionId: sessionId, OfferSDP: "b2ZmZXI=", PubKey: "offerer-" + utils.GetRandomId(), Timestamp: testTimestamp()}
+}
+
+func testAnswer(sessionId string) signaling.Answer {
+	return signaling.Answer{SessionId: sessionId, AnswerSDP: "YW5zd2Vy", PubKey: "answerer-" + utils.GetRandomId(), Timestamp: testTimestamp()}
+}
+
+func testTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// Returns a PIN that differs from `pin` in its first digit.
+func wrongPIN(pin string) string {
+	first := '0'
+	if pin[0] == '0' {
+		first = '1'
+	}
+	return string(first) + pin[1:]
+}
+
+// The offerer learns about the answer and completes the exchange with the
+// PIN handed to the answerer.
+func TestSessionExchange(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := testContext(t)
+	offerer, _ := ts.offer(t, "session")
+
+	answerer := ts.dial(t)
+	offer, err := answerer.FetchOffer(ctx, "session")
+	if err != nil {
+		t.Fatalf("fetch offer: %v", err)
+	}
+	if offer.OfferSDP != testOffer("session").OfferSDP {
+		t.Fatalf("got offer %q", offer.OfferSDP)
+	}
+	pin, err := answerer.SendAnswer(ctx, testAnswer("session"))
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+
+	if err := offerer.AwaitConfirmation(ctx); err != nil {
+		t.Fatalf("await confirmation: %v", err)
+	}
+	if _, err := offerer.FetchAnswer(ctx, "session", pin); err != nil {
+		t.Fatalf("fetch answer: %v", err)
+	}
+}
+
+// Metrics are only served by the internal listener.
+func TestMetricsInternalOnly(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name    string
+		handler http.Handler
+		status  int
+	}{
+		{"public listener", ts.engine, http.StatusNotFound},
+		{"internal listener", ts.metricsRouter(), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/metrics/", nil))
+			if recorder.Code != tt.status {
+				t.Fatalf("replied %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
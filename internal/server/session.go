@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/session"
+)
+
+// Loads the session record, mapping store failures to client errors.
+func (s *Server) loadSession(sessionId string) (*session.Record, error) {
+	record, err := s.sessions.Load(sessionId)
+	if errors.Is(err, session.ErrNotFound) {
+		return nil, fmt.Errorf("Session not found")
+	}
+	if err != nil {
+		log.Println("Cannot load the session:", err)
+		return nil, fmt.Errorf("A server error ocurred")
+	}
+	return record, nil
+}
+
+var ErrSessionConflict = &SessionError{Code: CodeConflict, Message: "Session changed by another request, try again"}
+
+// Moves the record to the given state and stores it. Illegal transitions
+// are reported with the reason the session cannot be used for the request.
+func (s *Server) transitionSession(record *session.Record, to session.State) error {
+	if err := record.Transition(to); err != nil {
+		return stateError(record.State)
+	}
+	return s.saveSession(record)
+}
+
+// Stores the record, reporting a request that lost a race for the session
+// with `ErrSessionConflict`.
+func (s *Server) saveSession(record *session.Record) error {
+	err := s.sessions.Save(record)
+	if errors.Is(err, session.ErrConflict) {
+		return ErrSessionConflict
+	}
+	if err != nil {
+		log.Println("Cannot save the session:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+	return nil
+}
+
+// Reports whether the session pages should be served for this id.
+func (s *Server) sessionAvailable(sessionId string) bool {
+	record, err := s.sessions.Load(sessionId)
+	return err == nil && !record.Terminal()
+}
+
+// Lifetime of a new session. The offerer may ask for one in seconds, up to
+// `SessionMaxLifetime`, otherwise `SessionTTL` is used.
+func (s *Server) sessionLifetime(requested int) (time.Duration, error) {
+	if requested == 0 {
+		return s.config.SessionTTL, nil
+	}
+	if requested < 0 {
+		return 0, fmt.Errorf("Invalid session TTL")
+	}
+
+	lifetime := time.Duration(requested) * time.Second
+	if lifetime > s.config.SessionMaxLifetime {
+		return 0, &SessionError{Code: CodeLimitReached, Message: "Session TTL exceeds the server maximum"}
+	}
+	return lifetime, nil
+}
+
+// Store TTL in seconds for data kept next to the session record, so it
+// does not outlive the session.
+func keyTTL(record *session.Record) int {
+	return max(int(record.Remaining().Seconds()), 1)
+}
+
+// The PIN expires after `PINTTL` or with the session, whichever is first.
+func (s *Server) pinTTL(record *session.Record) int {
+	return min(int(s.config.PINTTL.Seconds()), keyTTL(record))
+}
+
+// Client facing error for a request that is not allowed while the session
+// is in the given state.
+func stateError(state session.State) error {
+	switch state {
+	case session.Closed:
+		return &SessionError{Code: CodeSessionClosed, Message: "Session closed"}
+	case session.Expired:
+		return &SessionError{Code: CodeSessionExpired, Message: "Session expired"}
+	case session.Answered:
+		return &SessionError{Code: CodeInvalidState, Message: "Session already answered"}
+	case session.Confirmed:
+		return &SessionError{Code: CodeInvalidState, Message: "Session already completed"}
+	case session.Offered:
+		return &SessionError{Code: CodeInvalidState, Message: "Session not answered yet"}
+	default:
+		return &SessionError{Code: CodeInvalidState, Message: "Session not ready"}
+	}
+}
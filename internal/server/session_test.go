@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+func TestSessionStateMachine(t *testing.T) {
+	tests := []struct {
+		name string
+		// Brings the session into the state under test and makes the
+		// request that must be rejected.
+		run  func(t *testing.T, ts *testServer) error
+		want error
+	}{
+		{"offer for an existing session", func(t *testing.T, ts *testServer) error {
+			ts.offer(t, "session")
+			_, err := ts.dial(t).CreateSession(testContext(t), testOffer("session"))
+			return err
+		}, signaling.ErrInvalidState},
+		{"offer of an unknown session", func(t *testing.T, ts *testServer) error {
+			_, err := ts.dial(t).FetchOffer(testContext(t), "missing")
+			return err
+		}, signaling.ErrSessionNotFound},
+		{"offer of an answered session", func(t *testing.T, ts *testServer) error {
+			ts.offer(t, "session")
+			ts.answer(t, "session")
+			_, err := ts.dial(t).FetchOffer(testContext(t), "session")
+			return err
+		}, signaling.ErrInvalidState},
+		{"second answer", func(t *testing.T, ts *testServer) error {
+			ts.offer(t, "session")
+			ts.answer(t, "session")
+			_, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session"))
+			return err
+		}, signaling.ErrInvalidState},
+		{"answer after cancel", func(t *testing.T, ts *testServer) error {
+			offerer, _ := ts.offer(t, "session")
+			if err := offerer.CancelSession(testContext(t), "session"); err != nil {
+				t.Fatalf("cancel: %v", err)
+			}
+			_, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session"))
+			return err
+		}, signaling.ErrSessionClosed},
+		{"answer fetched before it exists", func(t *testing.T, ts *testServer) error {
+			offerer, _ := ts.offer(t, "session")
+			_, err := offerer.FetchAnswer(testContext(t), "session", "000000")
+			return err
+		}, signaling.ErrInvalidState},
+		{"answer after confirm", func(t *testing.T, ts *testServer) error {
+			offerer, _ := ts.offer(t, "session")
+			pin := ts.answer(t, "session")
+			if _, err := offerer.FetchAnswer(testContext(t), "session", pin); err != nil {
+				t.Fatalf("fetch answer: %v", err)
+			}
+			_, err := ts.dial(t).SendAnswer(testContext(t), testAnswer("session"))
+			return err
+		}, signaling.ErrSessionDone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if err := tt.run(t, ts); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
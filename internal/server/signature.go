@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/utils"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+var (
+	ErrSignatureRequired = &SessionError{Code: CodeBadSignature, Message: "Signature required"}
+	ErrInvalidSignature  = &SessionError{Code: CodeBadSignature, Message: "Invalid signature"}
+	ErrSigningKeyReused  = &SessionError{Code: CodeBadSignature, Message: "Signing key must differ from the public key"}
+	ErrStaleTimestamp    = &SessionError{Code: CodeReplayed, Message: "Timestamp outside the accepted window"}
+	ErrReplayedMessage   = &SessionError{Code: CodeReplayed, Message: "Message already received"}
+)
+
+// Verifies the signature of an offer or answer over its session id, SDP,
+// public key and timestamp, then rejects timestamps that are stale or were
+// already used in the session. Unsigned messages pass the signature check
+// unless signatures are required, but still have to carry a fresh
+// timestamp.
+//
+// The signature is checked against `signingKey`. An ECDH key must not be
+// reused for ECDSA, so a signing key equal to `pubKey` is refused.
+func (s *Server) verifySignature(sessionId, sdp, pubKey, signingKey, timestamp, signature string) error {
+	// Replays of unsigned messages are told apart by their public key.
+	identity := pubKey
+	if signature == "" {
+		if s.config.RequireSignatures {
+			return ErrSignatureRequired
+		}
+	} else {
+		if signingKey == "" {
+			return ErrInvalidSignature
+		}
+		if signingKey == pubKey {
+			return ErrSigningKeyReused
+		}
+		payload := signaling.SignedPayload(sessionId, sdp, pubKey, timestamp)
+		if err := signaling.Verify(signingKey, payload, signature); err != nil {
+			log.Println("Signature verification failed:", err)
+			return ErrInvalidSignature
+		}
+		identity = signingKey
+	}
+
+	signedAt, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	if age := time.Since(signedAt); age > s.config.SignatureMaxAge || age < -s.config.SignatureMaxAge {
+		return ErrStaleTimestamp
+	}
+
+	// A replay has to carry a timestamp inside the window, so remembering
+	// each one for twice the window is enough.
+	ttl := int((2 * s.config.SignatureMaxAge).Seconds())
+	first, err := s.store.SetNX(replayKey(sessionId, identity, timestamp), "1", ttl)
+	if err != nil {
+		log.Println("Cannot record the signed timestamp:", err)
+		return fmt.Errorf("A server error ocurred")
+	}
+	if !first {
+		return ErrReplayedMessage
+	}
+	return nil
+}
+
+func replayKey(sessionId string, identity string, timestamp string) string {
+	return utils.StoreKey("signed", sessionId, utils.HashSessionId(identity), timestamp)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+	"github.com/vladNed/hyperspace/internal/settings"
+	signaling "github.com/vladNed/hyperspace/pkg/signal"
+)
+
+func newSignatureServer(t *testing.T, requireSignatures bool) *Server {
+	t.Helper()
+
+	store := cache.NewMemory()
+	t.Cleanup(func() { store.Close() })
+	return &Server{
+		config: &settings.Settings{RequireSignatures: requireSignatures, SignatureMaxAge: time.Minute},
+		store:  store,
+	}
+}
+
+// Signs an offer the way the CLI does and returns it with a separate ECDH
+// style key in `PubKey`.
+func signedOffer(t *testing.T, signer crypto.Signer, timestamp time.Time) signaling.Offer {
+	t.Helper()
+
+	ecdhKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	pubKey, err := signaling.ExportSigningKey(ecdhKey.Public())
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	offer := signaling.Offer{
+		SessionId: "session",
+		OfferSDP:  "c2Rw",
+		PubKey:    pubKey,
+		Timestamp: timestamp.UTC().Format(time.RFC3339),
+	}
+	if err := offer.Sign(signer); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return offer
+}
+
+func verifyOffer(s *Server, offer signaling.Offer) error {
+	return s.verifySignature(offer.SessionId, offer.OfferSDP, offer.PubKey, offer.SigningKey, offer.Timestamp, offer.Signature)
+}
+
+func TestVerifySignatureKeys(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		signer crypto.Signer
+	}{
+		{"ecdsa p-256", p256},
+		{"ecdsa p-384", p384},
+		{"ed25519", ed25519Key},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignatureServer(t, true)
+			if err := verifyOffer(s, signedOffer(t, tt.signer, time.Now())); err != nil {
+				t.Fatalf("valid signature rejected: %v", err)
+			}
+		})
+	}
+}
+
+// WebCrypto produces raw r||s signatures instead of ASN.1.
+func TestVerifySignatureRawECDSA(t *testing.T) {
+	s := newSignatureServer(t, true)
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	offer := signedOffer(t, key, time.Now())
+
+	digest := sha512.Sum384(signaling.SignedPayload(offer.SessionId, offer.OfferSDP, offer.PubKey, offer.Timestamp))
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	raw := append(r.FillBytes(make([]byte, 48)), sig.FillBytes(make([]byte, 48))...)
+	offer.Signature = base64.StdEncoding.EncodeToString(raw)
+
+	if err := verifyOffer(s, offer); err != nil {
+		t.Fatalf("raw signature rejected: %v", err)
+	}
+}
+
+func TestVerifySignatureRejects(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	otherKey, _ := signaling.ExportSigningKey(other.Public())
+
+	tests := []struct {
+		name   string
+		modify func(*signaling.Offer)
+		want   error
+	}{
+		{"tampered sdp", func(o *signaling.Offer) { o.OfferSDP = "b3RoZXI=" }, ErrInvalidSignature},
+		{"other session", func(o *signaling.Offer) { o.SessionId = "other" }, ErrInvalidSignature},
+		{"other signing key", func(o *signaling.Offer) { o.SigningKey = otherKey }, ErrInvalidSignature},
+		{"swapped ecdh key", func(o *signaling.Offer) { o.PubKey = otherKey }, ErrInvalidSignature},
+		{"missing signing key", func(o *signaling.Offer) { o.SigningKey = "" }, ErrInvalidSignature},
+		{"signing key reused for ecdh", func(o *signaling.Offer) { o.PubKey = o.SigningKey }, ErrSigningKeyReused},
+		{"malformed signature", func(o *signaling.Offer) { o.Signature = "not base64" }, ErrInvalidSignature},
+		{"unsigned", func(o *signaling.Offer) { o.Signature = "" }, ErrSignatureRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignatureServer(t, true)
+			offer := signedOffer(t, key, time.Now())
+			tt.modify(&offer)
+
+			if err := verifyOffer(s, offer); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureUnsigned(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		timestamp string
+		want      error
+	}{
+		{"fresh", now.Format(time.RFC3339), nil},
+		{"missing timestamp", "", ErrStaleTimestamp},
+		{"stale timestamp", now.Add(-2 * time.Minute).Format(time.RFC3339), ErrStaleTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignatureServer(t, false)
+			if err := s.verifySignature("session", "c2Rw", "pub", "", tt.timestamp, ""); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureUnsignedReplay(t *testing.T) {
+	s := newSignatureServer(t, false)
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	if err := s.verifySignature("session", "c2Rw", "pub", "", timestamp, ""); err != nil {
+		t.Fatalf("first use rejected: %v", err)
+	}
+	if err := s.verifySignature("session", "c2Rw", "pub", "", timestamp, ""); !errors.Is(err, ErrReplayedMessage) {
+		t.Fatalf("replay: got %v, want ErrReplayedMessage", err)
+	}
+}
+
+func TestVerifySignatureStaleTimestamp(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		t.Run(offset.String(), func(t *testing.T) {
+			s := newSignatureServer(t, true)
+			offer := signedOffer(t, key, time.Now().Add(offset))
+			if err := verifyOffer(s, offer); !errors.Is(err, ErrStaleTimestamp) {
+				t.Fatalf("got %v, want ErrStaleTimestamp", err)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureReplay(t *testing.T) {
+	s := newSignatureServer(t, true)
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	offer := signedOffer(t, key, time.Now())
+
+	if err := verifyOffer(s, offer); err != nil {
+		t.Fatalf("first use rejected: %v", err)
+	}
+	if err := verifyOffer(s, offer); !errors.Is(err, ErrReplayedMessage) {
+		t.Fatalf("replay: got %v, want ErrReplayedMessage", err)
+	}
+
+	// The same timestamp signed by another key is not a replay.
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err := verifyOffer(s, signedOffer(t, other, time.Now())); err != nil {
+		t.Fatalf("other key rejected: %v", err)
+	}
+}
+
+// The answerer gets the signing key with the offer and can check the
+// signature itself.
+func TestSignedOfferForwarded(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	offer := signedOffer(t, key, time.Now())
+	if _, err := ts.dial(t).CreateSession(testContext(t), offer); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	fetched, err := ts.dial(t).FetchOffer(testContext(t), "session")
+	if err != nil {
+		t.Fatalf("fetch offer: %v", err)
+	}
+	if fetched.SigningKey != offer.SigningKey {
+		t.Fatal("signing key not forwarded")
+	}
+	if err := fetched.Verify("session"); err != nil {
+		t.Fatalf("forwarded offer does not verify: %v", err)
+	}
+
+	fetched.PubKey = "swapped"
+	if err := fetched.Verify("session"); !errors.Is(err, signaling.ErrBadSignature) {
+		t.Fatalf("swapped key: got %v, want ErrBadSignature", err)
+	}
+}
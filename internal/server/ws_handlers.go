@@ -2,38 +2,42 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/vladNed/hyperspace/internal/cache"
 	"github.com/vladNed/hyperspace/internal/hub"
+	"github.com/vladNed/hyperspace/internal/session"
 	"github.com/vladNed/hyperspace/internal/settings"
 	"github.com/vladNed/hyperspace/internal/utils"
 )
 
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		settings := settings.GetInstance()
-		origin := r.Header.Get("Origin")
-		if settings.AllowedOrigin == "" {
-			return origin != ""
-		}
-		return origin == settings.AllowedOrigin
-	},
+func newUpgrader(config *settings.Settings) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if config.AllowedOrigin == "" {
+				return origin != ""
+			}
+			return origin == config.AllowedOrigin
+		},
+	}
 }
 
-func wsHandler(c *gin.Context) {
-	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+func (s *Server) wsHandler(c *gin.Context) {
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot upgrade the connection"})
 		return
 	}
-	defer conn.Close()
+	client := s.hub.Register(conn)
+	defer s.hub.Unregister(client)
+	clientIP := c.ClientIP()
 
 	for {
 		var msgRaw SessionMessage
@@ -41,45 +45,83 @@ func wsHandler(c *gin.Context) {
 			log.Println("Error reading message:", err)
 			break
 		}
-		resp, err := parseMessage(msgRaw, conn)
+		resp, err := s.parseMessage(msgRaw, client, clientIP)
 		if err != nil {
 			newError := ErrorResponse{Message: err.Error()}
+			var sessionErr *SessionError
+			if errors.As(err, &sessionErr) {
+				newError.Code = sessionErr.Code
+			}
 			payloadBytes, _ := json.Marshal(newError)
-			conn.WriteJSON(SessionMessage{Payload: payloadBytes, Type: Error})
+			if err := client.Reply(SessionMessage{Payload: payloadBytes, Type: Error, ReplyTo: msgRaw.Type}); err != nil {
+				break
+			}
+			// The client cannot make sense of anything else we send.
+			if errors.Is(err, ErrUnsupportedVersion) {
+				client.CloseWithReason(websocket.CloseProtocolError, "unsupported protocol version")
+				break
+			}
+			continue
+		}
+
+		if resp == nil {
 			continue
 		}
 
 		respBytes, _ := json.Marshal(resp)
-		payload := SessionMessage{Payload: respBytes, Type: Ok}
-		if err = conn.WriteJSON(payload); err != nil {
+		payload := SessionMessage{Payload: respBytes, Type: Ok, ReplyTo: msgRaw.Type}
+		if err = client.Reply(payload); err != nil {
 			break
 		}
 	}
-
-	hub := hub.GetInstance()
-	go hub.RemoveSession(conn)
 }
 
-func parseMessage(rawMsg SessionMessage, conn *websocket.Conn) (any, error) {
+func (s *Server) parseMessage(rawMsg SessionMessage, client *hub.Client, clientIP string) (any, error) {
+	// Session ids end up in store keys, so they are limited to a charset
+	// that cannot name internal keys, see `utils.StoreKey`. This also keeps
+	// receiver records of broadcast sessions reachable only through their
+	// session, see broadcast.go.
+	var target SessionRequest
+	if err := json.Unmarshal(rawMsg.Payload, &target); err == nil && target.SessionId != "" && !utils.ValidId(target.SessionId) {
+		return nil, fmt.Errorf("Invalid session id")
+	}
+
+	if feature, ok := messageFeatures[rawMsg.Type]; ok {
+		if err := requireFeature(client, feature); err != nil {
+			return nil, err
+		}
+	}
+
 	switch rawMsg.Type {
+	case Hello:
+		var helloPayload HelloRequest
+		if err := json.Unmarshal(rawMsg.Payload, &helloPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleHello(helloPayload, client)
 	case Offer:
 		var offerPayload OfferRequest
 		if err := json.Unmarshal(rawMsg.Payload, &offerPayload); err != nil {
 			return nil, err
 		}
 
-		hubInstance := hub.GetInstance()
-		if hubInstance.CheckConnHasActiveSession(conn) {
+		if offerPayload.MaxReceivers > 0 {
+			if err := requireFeature(client, FeatureBroadcast); err != nil {
+				return nil, err
+			}
+		}
+		if s.hub.CheckClientHasActiveSession(client) {
 			return nil, fmt.Errorf("Already has an active session")
 		}
 
-		resp, err := handleNewOffer(offerPayload)
+		resp, err := s.handleNewOffer(offerPayload, client)
 		if err != nil {
 			return nil, err
 		}
 
-		hub := hub.GetInstance()
-		hub.AddSession(conn, offerPayload.SessionId)
+		s.hub.AddSession(client, offerPayload.SessionId, hub.Offerer)
+		s.trackSession(offerPayload.SessionId)
 
 		return resp, nil
 	case GetOffer:
@@ -87,64 +129,257 @@ func parseMessage(rawMsg SessionMessage, conn *websocket.Conn) (any, error) {
 		if err := json.Unmarshal(rawMsg.Payload, &getOfferPayload); err != nil {
 			return nil, err
 		}
-		return handleGetOffer(getOfferPayload)
+		return s.handleGetOffer(getOfferPayload)
 	case Answer:
 		var answerPayload AnswerRequest
 		if err := json.Unmarshal(rawMsg.Payload, &answerPayload); err != nil {
 			return nil, err
 		}
-		return handleNewAnswer(answerPayload, rawMsg.Payload)
+		if answerPayload.ReceiverId != "" {
+			if err := requireFeature(client, FeatureBroadcast); err != nil {
+				return nil, err
+			}
+			resp, err := s.handleReceiverAnswer(answerPayload, rawMsg.Payload, client)
+			if err != nil {
+				return nil, err
+			}
+
+			receiverId := receiverSessionId(answerPayload.SessionId, answerPayload.ReceiverId)
+			s.flushCandidates(receiverId, hub.Answerer, client)
+
+			return resp, nil
+		}
+
+		resp, err := s.handleNewAnswer(answerPayload, rawMsg.Payload, client)
+		if err != nil {
+			return nil, err
+		}
+
+		s.hub.AddSession(client, answerPayload.SessionId, hub.Answerer)
+		s.trackSession(answerPayload.SessionId)
+		s.flushCandidates(answerPayload.SessionId, hub.Answerer, client)
+
+		return resp, nil
 	case GetAnswer:
 		var getAnswerRequest GetAnswerRequest
 		if err := json.Unmarshal(rawMsg.Payload, &getAnswerRequest); err != nil {
 			return nil, err
 		}
 
-		return handleGetAnswerRequest(getAnswerRequest)
+		if getAnswerRequest.ReceiverId != "" {
+			if err := requireFeature(client, FeatureBroadcast); err != nil {
+				return nil, err
+			}
+			if role, ok := s.hub.GetRole(client, getAnswerRequest.SessionId); !ok || role != hub.Offerer {
+				return nil, fmt.Errorf("Not part of this session")
+			}
+
+			receiverId := receiverSessionId(getAnswerRequest.SessionId, getAnswerRequest.ReceiverId)
+			resp, err := s.handleGetAnswerRequest(GetAnswerRequest{SessionId: receiverId, Pin: getAnswerRequest.Pin}, clientIP)
+			if err != nil {
+				return nil, err
+			}
+
+			s.flushCandidates(receiverId, hub.Offerer, client)
+
+			return resp, nil
+		}
+
+		resp, err := s.handleGetAnswerRequest(getAnswerRequest, clientIP)
+		if err != nil {
+			return nil, err
+		}
+
+		if role, ok := s.hub.GetRole(client, getAnswerRequest.SessionId); ok && role == hub.Offerer {
+			s.flushCandidates(getAnswerRequest.SessionId, hub.Offerer, client)
+		}
+
+		return resp, nil
+	case CancelSession:
+		var cancelPayload SessionRequest
+		if err := json.Unmarshal(rawMsg.Payload, &cancelPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleCancelSession(cancelPayload, client)
+	case ExtendSession:
+		var extendPayload SessionRequest
+		if err := json.Unmarshal(rawMsg.Payload, &extendPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleExtendSession(extendPayload, client)
+	case Join:
+		var joinPayload SessionRequest
+		if err := json.Unmarshal(rawMsg.Payload, &joinPayload); err != nil {
+			return nil, err
+		}
+
+		if s.hub.CheckClientHasActiveSession(client) {
+			return nil, fmt.Errorf("Already has an active session")
+		}
+
+		resp, err := s.handleJoin(joinPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		s.hub.AddSession(client, resp.SessionId, hub.ReceiverRole(resp.ReceiverId))
+		s.trackSession(resp.SessionId)
+
+		return resp, nil
+	case ListReceivers:
+		var listPayload SessionRequest
+		if err := json.Unmarshal(rawMsg.Payload, &listPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleListReceivers(listPayload, client)
+	case ApproveReceiver:
+		var approvePayload OfferRequest
+		if err := json.Unmarshal(rawMsg.Payload, &approvePayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleApproveReceiver(approvePayload, client)
+	case JoinRoom:
+		var roomPayload RoomRequest
+		if err := json.Unmarshal(rawMsg.Payload, &roomPayload); err != nil {
+			return nil, err
+		}
+
+		if s.hub.CheckClientHasActiveSession(client) {
+			return nil, fmt.Errorf("Already has an active session")
+		}
+
+		return s.handleJoinRoom(roomPayload, client)
+	case LeaveRoom:
+		var roomPayload RoomRequest
+		if err := json.Unmarshal(rawMsg.Payload, &roomPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleLeaveRoom(roomPayload, client)
+	case ListMembers:
+		var roomPayload RoomRequest
+		if err := json.Unmarshal(rawMsg.Payload, &roomPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleListMembers(roomPayload, client)
+	case RoomOffer, RoomAnswer, RoomIceCandidate:
+		var signalPayload RoomSignal
+		if err := json.Unmarshal(rawMsg.Payload, &signalPayload); err != nil {
+			return nil, err
+		}
+
+		return s.handleRoomSignal(rawMsg.Type, signalPayload, client)
+	case Resume:
+		var resumePayload ResumeRequest
+		if err := json.Unmarshal(rawMsg.Payload, &resumePayload); err != nil {
+			return nil, err
+		}
+
+		if s.hub.CheckClientHasActiveSession(client) {
+			return nil, fmt.Errorf("Already has an active session")
+		}
+
+		resp, err := s.handleResume(resumePayload, client)
+		if err != nil {
+			return nil, err
+		}
+
+		s.hub.AddSession(client, resp.SessionId, resp.Role)
+		s.trackSession(resp.SessionId)
+		if resp.State == session.Confirmed {
+			s.flushCandidates(resp.SessionId, resp.Role, client)
+		}
+
+		return resp, nil
+	case IceCandidate, EndOfCandidates:
+		var candidatePayload IceCandidateRequest
+		if err := json.Unmarshal(rawMsg.Payload, &candidatePayload); err != nil {
+			return nil, err
+		}
+
+		return nil, s.handleIceCandidate(candidatePayload, rawMsg, client)
 	default:
 		return nil, fmt.Errorf("Unknown message type: %s", rawMsg.Type)
 	}
 }
 
-func handleNewOffer(msg OfferRequest) (*OfferResponse, error) {
-	cacheClient := cache.NewRedis()
-	config := settings.GetInstance()
+func (s *Server) handleNewOffer(msg OfferRequest, client *hub.Client) (*OfferResponse, error) {
+	if err := s.verifySignature(msg.SessionId, msg.OfferSDP, msg.PubKey, msg.SigningKey, msg.Timestamp, msg.Signature); err != nil {
+		return nil, err
+	}
+
+	lifetime, err := s.sessionLifetime(msg.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MaxReceivers < 0 {
+		return nil, fmt.Errorf("Invalid number of receivers")
+	}
+	if msg.MaxReceivers > s.config.BroadcastMaxReceivers {
+		return nil, &SessionError{Code: CodeLimitReached, Message: "Too many receivers requested"}
+	}
 
-	msgRaw, _ := json.Marshal(msg)
-	if err := cacheClient.Set(msg.SessionId, msgRaw, config.RedisTTL); err != nil {
-		log.Println("Cannot save the offer:", err)
+	record, err := s.sessions.Create(msg.SessionId, lifetime)
+	if errors.Is(err, session.ErrExists) {
+		return nil, &SessionError{Code: CodeInvalidState, Message: "Session already exists"}
+	}
+	if err != nil {
+		log.Println("Cannot create the session:", err)
 		return nil, fmt.Errorf("Cannot save the offer")
 	}
 
-	resp := &OfferResponse{Message: "Ok"}
+	record.Offer, _ = json.Marshal(msg)
+	record.MaxReceivers = msg.MaxReceivers
+	if err := s.transitionSession(record, session.Offered); err != nil {
+		return nil, err
+	}
+
+	resumeToken, err := s.attachPeer(record, hub.Offerer, client)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &OfferResponse{Message: "Ok", ResumeToken: resumeToken}
 	return resp, nil
 }
 
-func handleNewAnswer(msg AnswerRequest, raw json.RawMessage) (*AnswerResponse, error) {
-	hubInstance := hub.GetInstance()
-	pinManager := utils.GetPinManagerInstance()
-	cacheClient := cache.NewRedis()
-	config := settings.GetInstance()
-
-	peerConnect := hubInstance.GetConnBySessionId(msg.SessionId)
-	if peerConnect == nil {
+func (s *Server) handleNewAnswer(msg AnswerRequest, raw json.RawMessage, client *hub.Client) (*AnswerResponse, error) {
+	record, err := s.sessions.Load(msg.SessionId)
+	if err != nil {
 		return nil, fmt.Errorf("Peer connection not found")
 	}
-
-	pin, err := pinManager.GeneratePIN()
-	if err != nil {
-		// TODO: Invalidate sessions on both ends
-		return nil, fmt.Errorf("Cannot generate PIN")
+	if record.Broadcast() {
+		return nil, ErrBroadcastSession
+	}
+	if !record.CanTransition(session.Answered) {
+		if record.State == session.Answered || record.State == session.Confirmed {
+			s.notifyAnswerRejected(msg.SessionId)
+		}
+		return nil, stateError(record.State)
+	}
+	if err := s.verifySignature(msg.SessionId, msg.AnswerSDP, msg.PubKey, msg.SigningKey, msg.Timestamp, msg.Signature); err != nil {
+		return nil, err
+	}
+	if err := s.claimAnswerer(record, client); err != nil {
+		return nil, err
 	}
 
-	if err := cacheClient.Set(fmt.Sprintf("%s-pin", msg.SessionId), pin, config.RedisTTL); err != nil {
-		// TODO: Invalidate sessions on both ends
-		return nil, fmt.Errorf("Cannot save the PIN")
+	pin, err := s.reservePIN(record)
+	if err != nil {
+		s.releaseAnswerer(msg.SessionId)
+		return nil, err
 	}
 
-	if err := cacheClient.Set(msg.SessionId, string(raw), config.RedisTTL); err != nil {
-		// TODO: Invalidate sessions on both ends
-		return nil, fmt.Errorf("Cannot save the answer")
+	record.Answer = raw
+	if err := s.transitionSession(record, session.Answered); err != nil {
+		s.releasePIN(record.Id, pin)
+		s.releaseAnswerer(msg.SessionId)
+		return nil, err
 	}
 	answerSendResp := &AnswerResponse{Message: "Ok", Pin: pin}
 	peerConnectPayload := &SessionMessage{
@@ -152,47 +387,76 @@ func handleNewAnswer(msg AnswerRequest, raw json.RawMessage) (*AnswerResponse, e
 		Payload: json.RawMessage([]byte("{}")),
 	}
 
+	// The answer is stored, the offerer learns about it from the session
+	// state once it resumes even if this message is lost.
 	rawPayload, _ := json.Marshal(peerConnectPayload)
-	hubInstance.BroadcastMessage(hub.BroadcastPayload{
-		Conn:    peerConnect,
-		Message: rawPayload,
-	})
+	if err := s.hub.BroadcastMessage(hub.BroadcastPayload{
+		SessionId: msg.SessionId,
+		Role:      hub.Offerer,
+		Message:   rawPayload,
+	}); err != nil {
+		log.Println("Cannot notify the offerer:", err)
+	}
 
 	return answerSendResp, nil
 }
 
-func handleGetOffer(msg SessionRequest) (*SessionResponse, error) {
-	cacheClient := cache.NewRedis()
-	sessionData, err := cacheClient.Get(msg.SessionId)
+func (s *Server) handleGetOffer(msg SessionRequest) (*SessionResponse, error) {
+	record, err := s.loadSession(msg.SessionId)
 	if err != nil {
-		return nil, fmt.Errorf("Session not found")
+		return nil, err
+	}
+	if record.Broadcast() {
+		return nil, ErrBroadcastSession
+	}
+	if record.State != session.Offered {
+		return nil, stateError(record.State)
 	}
 
 	var offerRequest OfferRequest
-	err = json.Unmarshal([]byte(sessionData), &offerRequest)
+	err = json.Unmarshal(record.Offer, &offerRequest)
 	if err != nil {
 		log.Println("Cannot unmarshal offer request:", err)
 		return nil, fmt.Errorf("A server error ocurred")
 	}
 
-	getOfferResp := &SessionResponse{OfferSDP: offerRequest.OfferSDP, PubKey: offerRequest.PubKey}
+	getOfferResp := &SessionResponse{
+		OfferSDP:   offerRequest.OfferSDP,
+		PubKey:     offerRequest.PubKey,
+		SigningKey: offerRequest.SigningKey,
+		Timestamp:  offerRequest.Timestamp,
+		Signature:  offerRequest.Signature,
+	}
 
 	return getOfferResp, nil
 }
 
-func handleGetAnswerRequest(msg GetAnswerRequest) (*AnswerRequest, error) {
-	cacheClient := cache.NewRedis()
-	if cachePin, err := cacheClient.Get(fmt.Sprintf("%s-pin", msg.SessionId)); err != nil || cachePin != msg.Pin {
-		return nil, fmt.Errorf("Invalid PIN")
+func (s *Server) handleGetAnswerRequest(msg GetAnswerRequest, clientIP string) (*AnswerRequest, error) {
+	if err := s.checkPINLockout(msg.SessionId, clientIP); err != nil {
+		return nil, err
 	}
-
-	answerRaw, err := cacheClient.Get(msg.SessionId)
+	record, err := s.loadSession(msg.SessionId)
 	if err != nil {
-		return nil, fmt.Errorf("Answer not found")
+		return nil, err
+	}
+	if !record.CanTransition(session.Confirmed) {
+		return nil, stateError(record.State)
+	}
+	if err := s.checkPIN(msg.SessionId, clientIP, msg.Pin); err != nil {
+		return nil, err
 	}
+	// The PIN stays valid until the session is confirmed, a request that
+	// loses the race for the record can be retried with it.
+	if err := s.transitionSession(record, session.Confirmed); err != nil {
+		return nil, err
+	}
+	s.consumePIN(msg.SessionId)
 
 	var answer AnswerRequest
-	json.Unmarshal([]byte(answerRaw), &answer)
+	if err := json.Unmarshal(record.Answer, &answer); err != nil {
+		log.Println("Cannot unmarshal the answer:", err)
+		return nil, fmt.Errorf("Answer not found")
+	}
 
 	return &answer, nil
 }
@@ -0,0 +1,246 @@
+// Package session holds the server side record of a signaling session and
+// the rules for moving it through its lifecycle:
+//
+//	created -> offered -> answered -> confirmed
+//
+// Any state that is not terminal can move to closed or expired.
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+)
+
+// How long a closed or expired record is kept around so that late requests
+// get a precise error instead of "not found".
+const RECORD_RETENTION = 5 * time.Minute
+
+// Times closing or expiring a session is retried when the record keeps
+// changing underneath it.
+const END_RETRIES = 3
+
+type State string
+
+const (
+	Created   State = "created"
+	Offered   State = "offered"
+	Answered  State = "answered"
+	Confirmed State = "confirmed"
+	Closed    State = "closed"
+	Expired   State = "expired"
+)
+
+var transitions = map[State][]State{
+	Created:   {Offered, Closed, Expired},
+	Offered:   {Answered, Closed, Expired},
+	Answered:  {Confirmed, Closed, Expired},
+	Confirmed: {Closed, Expired},
+}
+
+var (
+	ErrNotFound = errors.New("session not found")
+	ErrExists   = errors.New("session already exists")
+	// The record changed since it was loaded, the caller has to load it
+	// again and retry.
+	ErrConflict = errors.New("session changed concurrently")
+)
+
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invalid session transition from %s to %s", e.From, e.To)
+}
+
+// Record is stored under the session id. The offer and answer are kept
+// side by side so neither overwrites the other.
+//
+// Saving only succeeds while the stored record is still the one that was
+// loaded, so two requests racing on the same session cannot both move it.
+type Record struct {
+	Id        string          `json:"id"`
+	State     State           `json:"state"`
+	Offer     json.RawMessage `json:"offer,omitempty"`
+	Answer    json.RawMessage `json:"answer,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	// Lifetime the session was created with, also used when extending it.
+	Lifetime time.Duration `json:"lifetime"`
+	// Set for broadcast sessions, which accept several answerers.
+	MaxReceivers int `json:"maxReceivers,omitempty"`
+	// Bumped on every save so a stale record never matches the stored one.
+	Version int64 `json:"version"`
+
+	// Stored value the record was read from, compared on save.
+	stored string
+}
+
+func (r *Record) Broadcast() bool {
+	return r.MaxReceivers > 0
+}
+
+// Time left until the session expires.
+func (r *Record) Remaining() time.Duration {
+	return time.Until(r.ExpiresAt)
+}
+
+// Terminal states accept no further transitions.
+func (r *Record) Terminal() bool {
+	return len(transitions[r.State]) == 0
+}
+
+func (r *Record) CanTransition(to State) bool {
+	for _, allowed := range transitions[r.State] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Record) Transition(to State) error {
+	if !r.CanTransition(to) {
+		return &TransitionError{From: r.State, To: to}
+	}
+	r.State = to
+	return nil
+}
+
+// Records reads and writes session records in the cache store.
+type Records struct {
+	store cache.Store
+}
+
+func NewRecords(store cache.Store) *Records {
+	return &Records{store: store}
+}
+
+// Creates the record in the `Created` state. Fails with `ErrExists` when
+// the id is already taken, even by a closed session.
+func (rs *Records) Create(id string, lifetime time.Duration) (*Record, error) {
+	now := time.Now()
+	record := &Record{
+		Id:        id,
+		State:     Created,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+		Lifetime:  lifetime,
+	}
+	recordRaw, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := rs.store.SetNX(id, recordRaw, rs.ttl(record))
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrExists
+	}
+	record.stored = string(recordRaw)
+	return record, nil
+}
+
+// Loads the record, moving it to `Expired` once its lifetime is over.
+func (rs *Records) Load(id string) (*Record, error) {
+	recordRaw, err := rs.store.Get(id)
+	if errors.Is(err, cache.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record Record
+	if err := json.Unmarshal([]byte(recordRaw), &record); err != nil {
+		return nil, fmt.Errorf("cannot decode session record: %w", err)
+	}
+	record.stored = recordRaw
+
+	if !record.Terminal() && time.Now().After(record.ExpiresAt) {
+		record.State = Expired
+		err := rs.Save(&record)
+		if errors.Is(err, ErrConflict) {
+			return rs.Load(id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// Stores the record if nobody saved it since it was loaded, otherwise
+// fails with `ErrConflict` and leaves the stored record untouched.
+func (rs *Records) Save(record *Record) error {
+	next := *record
+	next.Version++
+	recordRaw, err := json.Marshal(&next)
+	if err != nil {
+		return err
+	}
+
+	swapped, err := rs.store.CompareAndSwap(record.Id, record.stored, recordRaw, rs.ttl(&next))
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrConflict
+	}
+	next.stored = string(recordRaw)
+	*record = next
+	return nil
+}
+
+// Moves the session to `Closed` unless it already ended. The offer and
+// answer are dropped, only the state is kept.
+func (rs *Records) Close(id string) error {
+	return rs.end(id, Closed)
+}
+
+// Same as `Close` for a session whose lifetime is over.
+func (rs *Records) Expire(id string) error {
+	return rs.end(id, Expired)
+}
+
+// Ending a session wins over any other transition, so a conflict is
+// retried against the fresh record.
+func (rs *Records) end(id string, state State) error {
+	for range END_RETRIES {
+		record, err := rs.Load(id)
+		if err != nil {
+			return err
+		}
+		if record.Terminal() {
+			return nil
+		}
+
+		if err := record.Transition(state); err != nil {
+			return err
+		}
+		record.Offer = nil
+		record.Answer = nil
+		err = rs.Save(record)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// Records outlive the session by `RECORD_RETENTION`. Terminal records
+// only need to live for the retention period.
+func (rs *Records) ttl(record *Record) int {
+	ttl := RECORD_RETENTION
+	if !record.Terminal() {
+		ttl += record.Remaining()
+	}
+	return int(ttl.Seconds())
+}
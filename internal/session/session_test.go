@@ -0,0 +1,161 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vladNed/hyperspace/internal/cache"
+)
+
+func newTestRecords(t *testing.T) *Records {
+	t.Helper()
+
+	store := cache.NewMemory()
+	t.Cleanup(func() { store.Close() })
+	return NewRecords(store)
+}
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		from    State
+		to      State
+		allowed bool
+	}{
+		{Created, Offered, true},
+		{Offered, Answered, true},
+		{Answered, Confirmed, true},
+		{Created, Closed, true},
+		{Offered, Expired, true},
+		{Confirmed, Closed, true},
+		{Created, Answered, false},
+		{Offered, Confirmed, false},
+		{Answered, Offered, false},
+		{Confirmed, Answered, false},
+		{Closed, Offered, false},
+		{Closed, Expired, false},
+		{Expired, Closed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			record := &Record{State: tt.from}
+			err := record.Transition(tt.to)
+
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("transition rejected: %v", err)
+				}
+				if record.State != tt.to {
+					t.Fatalf("state is %s, want %s", record.State, tt.to)
+				}
+				return
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) {
+				t.Fatalf("got %v, want a TransitionError", err)
+			}
+			if record.State != tt.from {
+				t.Fatalf("state changed to %s on a rejected transition", record.State)
+			}
+		})
+	}
+}
+
+func TestRecordsCreate(t *testing.T) {
+	records := newTestRecords(t)
+
+	if _, err := records.Create("session", time.Minute); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := records.Create("session", time.Minute); !errors.Is(err, ErrExists) {
+		t.Fatalf("second create: got %v, want ErrExists", err)
+	}
+
+	record, err := records.Load("session")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if record.State != Created {
+		t.Fatalf("state is %s, want %s", record.State, Created)
+	}
+	if _, err := records.Load("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("load missing: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRecordsSaveConflict(t *testing.T) {
+	records := newTestRecords(t)
+	if _, err := records.Create("session", time.Minute); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	extend, _ := records.Load("session")
+	offer, _ := records.Load("session")
+
+	offer.Transition(Offered)
+	if err := records.Save(offer); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	extend.ExpiresAt = extend.ExpiresAt.Add(time.Minute)
+	if err := records.Save(extend); !errors.Is(err, ErrConflict) {
+		t.Fatalf("stale save: got %v, want ErrConflict", err)
+	}
+
+	stored, _ := records.Load("session")
+	if stored.State != Offered {
+		t.Fatalf("state is %s, want %s", stored.State, Offered)
+	}
+
+	// The saved record can keep being used.
+	offer.Transition(Answered)
+	if err := records.Save(offer); err != nil {
+		t.Fatalf("second save: %v", err)
+	}
+}
+
+func TestRecordsCloseWinsOverAnswer(t *testing.T) {
+	records := newTestRecords(t)
+	record, _ := records.Create("session", time.Minute)
+	record.Transition(Offered)
+	records.Save(record)
+
+	answer, _ := records.Load("session")
+	if err := records.Close("session"); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	answer.Transition(Answered)
+	if err := records.Save(answer); !errors.Is(err, ErrConflict) {
+		t.Fatalf("answer after close: got %v, want ErrConflict", err)
+	}
+
+	stored, _ := records.Load("session")
+	if stored.State != Closed {
+		t.Fatalf("state is %s, want %s", stored.State, Closed)
+	}
+	if err := records.Close("session"); err != nil {
+		t.Fatalf("closing twice: %v", err)
+	}
+}
+
+func TestRecordsLoadExpires(t *testing.T) {
+	records := newTestRecords(t)
+	if _, err := records.Create("session", time.Millisecond); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	record, err := records.Load("session")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if record.State != Expired {
+		t.Fatalf("state is %s, want %s", record.State, Expired)
+	}
+	if err := record.Transition(Offered); err == nil {
+		t.Fatal("expired session accepted an offer")
+	}
+}
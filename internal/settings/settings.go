@@ -3,18 +3,95 @@ package settings
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Settings struct {
 	Env           string
+	Port          string
 	AllowedOrigin string
+	CacheBackend  string
 	RedisAddr     string
 	RedisPort     string
-	RedisTTL      int
 	WSOrigin      string
+
+	// TLS settings used when connecting to redis. Verification of the server
+	// certificate is always on when TLS is enabled.
+	RedisTLS        bool
+	RedisCACert     string
+	RedisClientCert string
+	RedisClientKey  string
+	RedisServerName string
+
+	// Websocket keepalive. Peers that do not answer a ping within
+	// `WSPongWait` are considered dead and their sessions are dropped.
+	WSPingInterval time.Duration
+	WSPongWait     time.Duration
+	WSWriteWait    time.Duration
+
+	// Messages queued per websocket before `WSSlowConsumerPolicy` kicks in:
+	// "drop" discards further messages, "disconnect" closes the socket.
+	WSSendQueueSize      int
+	WSSlowConsumerPolicy string
+
+	// Largest message in bytes accepted from a websocket.
+	WSMaxMessageSize int
+
+	// How long in-flight connections get to drain on SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// Address of the internal listener serving `/api/v1/metrics/`, such as
+	// `127.0.0.1:9090`. Metrics are not served when it is empty.
+	MetricsAddr string
+
+	// PIN brute-force protection. A session is invalidated after
+	// `PINMaxAttempts` wrong PINs, a client IP is locked out for
+	// `PINLockoutDuration` after `PINMaxAttemptsPerIP` wrong PINs.
+	PINMaxAttempts      int
+	PINMaxAttemptsPerIP int
+	PINLockoutDuration  time.Duration
+
+	// Addresses or CIDRs of the load balancers in front of the server. The
+	// client IP used for the PIN limits is taken from their
+	// X-Forwarded-For header, without them every client behind a load
+	// balancer would share its address.
+	TrustedProxies []string
+
+	// Offers and answers may be signed with the advertised public key.
+	// Signed messages are always verified, unsigned ones are rejected when
+	// `RequireSignatures` is set. `SignatureMaxAge` bounds how far the
+	// signed timestamp may drift from the server clock.
+	RequireSignatures bool
+	SignatureMaxAge   time.Duration
+
+	// Default lifetime of a session and of the PIN handed to its answerer.
+	// Offerers may ask for another session lifetime, peers are warned
+	// `SessionExpiryWarning` before their session expires and may extend it,
+	// both up to `SessionMaxLifetime` after its creation.
+	SessionTTL           time.Duration
+	PINTTL               time.Duration
+	SessionExpiryWarning time.Duration
+	SessionMaxLifetime   time.Duration
+
+	// How long a session waits for a peer holding a resume token to come
+	// back after its connection dropped.
+	ResumeGracePeriod time.Duration
+
+	// Upper bound for the receivers an offerer may ask for in a broadcast
+	// session.
+	BroadcastMaxReceivers int
+
+	// Rooms hold up to `RoomMaxMembers` members and are forgotten
+	// `RoomTTL` after their membership last changed.
+	RoomMaxMembers int
+	RoomTTL        time.Duration
+	// A member counts as gone `RoomMemberTTL` after its connection last
+	// refreshed it, e.g. when the instance holding it crashed.
+	RoomMemberTTL time.Duration
 }
 
 var instance *Settings
@@ -28,6 +105,13 @@ func GetInstance() *Settings {
 }
 
 func (s *Settings) loadEnvVars() {
+	// Values from the environment take precedence over the config file.
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		if err := godotenv.Load(configFile); err != nil {
+			log.Fatalf("cannot load config file %s: %v\n", configFile, err)
+		}
+	}
+
 	env := os.Getenv("ENV")
 	if env != "prod" {
 		err := godotenv.Load()
@@ -36,24 +120,133 @@ func (s *Settings) loadEnvVars() {
 		}
 	}
 	s.Env = env
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		log.Fatalln("REDIS_ADDR is not set")
+	s.Port = getEnvOrDefault("PORT", "8080")
+	s.CacheBackend = os.Getenv("CACHE_BACKEND")
+	if s.CacheBackend == "" {
+		s.CacheBackend = "redis"
 	}
-	s.RedisAddr = redisAddr
 
-	redisPort := os.Getenv("REDIS_PORT")
-	if redisPort == "" {
-		log.Fatalln("REDIS_PORT is not set")
+	if s.CacheBackend == "redis" {
+		redisAddr := os.Getenv("REDIS_ADDR")
+		if redisAddr == "" {
+			log.Fatalln("REDIS_ADDR is not set")
+		}
+		s.RedisAddr = redisAddr
+
+		redisPort := os.Getenv("REDIS_PORT")
+		if redisPort == "" {
+			log.Fatalln("REDIS_PORT is not set")
+		}
+		s.RedisPort = redisPort
+
+		s.RedisTLS = getEnvBool("REDIS_TLS", true)
+		s.RedisCACert = getEnvOrDefault("REDIS_CA_CERT", "./certs/ca.crt")
+		s.RedisClientCert = getEnvOrDefault("REDIS_CLIENT_CERT", "./certs/client.crt")
+		s.RedisClientKey = getEnvOrDefault("REDIS_CLIENT_KEY", "./certs/client.key")
+		s.RedisServerName = getEnvOrDefault("REDIS_SERVER_NAME", redisAddr)
 	}
-	s.RedisPort = redisPort
 	s.AllowedOrigin = os.Getenv("ALLOWED_ORIGIN")
-	s.RedisTTL = 300
+
+	s.WSPongWait = getEnvDuration("WS_PONG_WAIT", 60*time.Second)
+	s.WSPingInterval = getEnvDuration("WS_PING_INTERVAL", 54*time.Second)
+	s.WSWriteWait = getEnvDuration("WS_WRITE_WAIT", 10*time.Second)
+	if s.WSPingInterval >= s.WSPongWait {
+		log.Fatalln("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT")
+	}
+	s.WSMaxMessageSize = getEnvInt("WS_MAX_MESSAGE_SIZE", 64*1024)
+	s.WSSendQueueSize = getEnvInt("WS_SEND_QUEUE_SIZE", 256)
+	s.WSSlowConsumerPolicy = getEnvOrDefault("WS_SLOW_CONSUMER_POLICY", "disconnect")
+	if s.WSSlowConsumerPolicy != "drop" && s.WSSlowConsumerPolicy != "disconnect" {
+		log.Fatalf("WS_SLOW_CONSUMER_POLICY must be drop or disconnect, got %q\n", s.WSSlowConsumerPolicy)
+	}
+	s.ShutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	s.MetricsAddr = os.Getenv("METRICS_ADDR")
+
+	s.PINMaxAttempts = getEnvInt("PIN_MAX_ATTEMPTS", 5)
+	s.PINMaxAttemptsPerIP = getEnvInt("PIN_MAX_ATTEMPTS_PER_IP", 20)
+	s.PINLockoutDuration = getEnvDuration("PIN_LOCKOUT_DURATION", 15*time.Minute)
+	s.TrustedProxies = getEnvList("TRUSTED_PROXIES")
+
+	s.RequireSignatures = getEnvBool("REQUIRE_SIGNATURES", false)
+	s.SignatureMaxAge = getEnvDuration("SIGNATURE_MAX_AGE", time.Minute)
+
+	s.SessionExpiryWarning = getEnvDuration("SESSION_EXPIRY_WARNING", time.Minute)
+	s.SessionMaxLifetime = getEnvDuration("SESSION_MAX_LIFETIME", 30*time.Minute)
+	s.SessionTTL = getEnvDuration("SESSION_TTL", 5*time.Minute)
+	s.PINTTL = getEnvDuration("PIN_TTL", 5*time.Minute)
+	if s.SessionTTL > s.SessionMaxLifetime {
+		log.Fatalln("SESSION_TTL must not exceed SESSION_MAX_LIFETIME")
+	}
+	if s.SessionExpiryWarning >= s.SessionTTL {
+		log.Fatalln("SESSION_EXPIRY_WARNING must be shorter than SESSION_TTL")
+	}
+	s.ResumeGracePeriod = getEnvDuration("RESUME_GRACE_PERIOD", 30*time.Second)
+	s.BroadcastMaxReceivers = getEnvInt("BROADCAST_MAX_RECEIVERS", 10)
+	s.RoomMaxMembers = getEnvInt("ROOM_MAX_MEMBERS", 16)
+	s.RoomTTL = getEnvDuration("ROOM_TTL", 24*time.Hour)
+	s.RoomMemberTTL = getEnvDuration("ROOM_MEMBER_TTL", 30*time.Second)
+	if s.RoomMemberTTL < 3*time.Second {
+		log.Fatalln("ROOM_MEMBER_TTL must be at least 3s")
+	}
 
 	if env == "prod" {
 		s.WSOrigin = strings.ReplaceAll(s.AllowedOrigin, "https", "wss")
 	} else {
 		s.WSOrigin = "ws://localhost:8080"
 	}
+}
+
+func getEnvOrDefault(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
 
+// Comma separated list, nil when the variable is not set.
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean, got %q\n", key, value)
+	}
+	return parsed
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Fatalf("%s must be a positive integer, got %q\n", key, value)
+	}
+	return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Fatalf("%s must be a positive duration, got %q\n", key, value)
+	}
+	return parsed
 }
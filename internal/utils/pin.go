@@ -8,46 +8,49 @@ import (
 	"time"
 )
 
-type PINManager struct {
-	// TODO: If this becomes unmanageable, use a cache like redis
+// PINManager hands out PINs that are unique among the active ones.
+type PINManager interface {
+	GeneratePIN() (string, error)
+	RemovePIN(pin string) error
+	Stop()
+}
+
+// MemoryPINManager tracks active PINs in process memory. It is only unique
+// within a single instance, see `StorePINManager` for deployments with
+// several replicas.
+type MemoryPINManager struct {
 	active map[string]time.Time
+	ttl    time.Duration
 	mutex  sync.Mutex
+	stop   chan struct{}
+	closed sync.Once
 }
 
-var (
-	pinManagerInstance *PINManager
-	once               sync.Once
-)
-
 const (
 	MAX_PIN_SIZE          = 1000000
 	MAX_GENERATE_ATTEMPTS = 10
-	EXPIRATION_TIME       = 5 * time.Minute
 )
 
-func GetPinManagerInstance() *PINManager {
-	once.Do(func() {
-		pinManagerInstance = &PINManager{
-			active: make(map[string]time.Time),
-		}
+// PINs stay reserved for `ttl`, which should match `settings.PINTTL`.
+func NewMemoryPINManager(ttl time.Duration) *MemoryPINManager {
+	pm := &MemoryPINManager{
+		active: make(map[string]time.Time),
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+	}
 
-		go pinManagerInstance.cleanupExpiredPINs()
-	})
+	go pm.cleanupExpiredPINs()
 
-	return pinManagerInstance
+	return pm
 }
 
-func (pm *PINManager) GeneratePIN() (string, error) {
-	max := big.NewInt(MAX_PIN_SIZE)
-
+func (pm *MemoryPINManager) GeneratePIN() (string, error) {
 	for range MAX_GENERATE_ATTEMPTS {
-		n, err := rand.Int(rand.Reader, max)
+		pin, err := randomPIN()
 		if err != nil {
 			return "", err
 		}
 
-		pin := fmt.Sprintf("%06d", n)
-
 		pm.mutex.Lock()
 		expiryTime, exists := pm.active[pin]
 		pm.mutex.Unlock()
@@ -57,7 +60,7 @@ func (pm *PINManager) GeneratePIN() (string, error) {
 		}
 
 		pm.mutex.Lock()
-		pm.active[pin] = time.Now().Add(EXPIRATION_TIME)
+		pm.active[pin] = time.Now().Add(pm.ttl)
 		pm.mutex.Unlock()
 
 		return pin, nil
@@ -66,25 +69,47 @@ func (pm *PINManager) GeneratePIN() (string, error) {
 	return "", fmt.Errorf("Cannot generate a unique PIN")
 }
 
-func (pm *PINManager) RemovePIN(pin string) {
+func (pm *MemoryPINManager) RemovePIN(pin string) error {
 	pm.mutex.Lock()
 	delete(pm.active, pin)
 	pm.mutex.Unlock()
+
+	return nil
 }
 
-// Cleanup expired PINs every 5 minutes
-func (pm *PINManager) cleanupExpiredPINs() {
-	ticker := time.NewTicker(EXPIRATION_TIME)
+// Stops the cleanup goroutine. Safe to call more than once.
+func (pm *MemoryPINManager) Stop() {
+	pm.closed.Do(func() {
+		close(pm.stop)
+	})
+}
+
+// Cleanup expired PINs once per PIN lifetime
+func (pm *MemoryPINManager) cleanupExpiredPINs() {
+	ticker := time.NewTicker(pm.ttl)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		now := time.Now()
-		pm.mutex.Lock()
-		for pin, exp := range pm.active {
-			if now.After(exp) {
-				delete(pm.active, pin)
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			pm.mutex.Lock()
+			for pin, exp := range pm.active {
+				if now.After(exp) {
+					delete(pm.active, pin)
+				}
 			}
+			pm.mutex.Unlock()
+		case <-pm.stop:
+			return
 		}
-		pm.mutex.Unlock()
 	}
 }
+
+func randomPIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(MAX_PIN_SIZE))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n), nil
+}
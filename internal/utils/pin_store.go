@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kind of the store keys reserving active PINs, see `StoreKey`.
+const PIN_KEY_KIND = "active-pin"
+
+// Subset of `cache.Store` used to reserve PINs. The cache package depends
+// on utils, so the store is accepted through this interface.
+type pinStore interface {
+	SetNX(key string, value any, ttl int) (bool, error)
+	Del(key string) error
+}
+
+// StorePINManager reserves PINs in the shared session store with an atomic
+// set-if-not-exists, so replicas never hand out the same PIN and active
+// PINs survive restarts. Reservations expire after `ttl`.
+type StorePINManager struct {
+	store pinStore
+	ttl   time.Duration
+}
+
+func NewStorePINManager(store pinStore, ttl time.Duration) *StorePINManager {
+	return &StorePINManager{store: store, ttl: ttl}
+}
+
+func (pm *StorePINManager) GeneratePIN() (string, error) {
+	ttl := int(pm.ttl.Seconds())
+
+	for range MAX_GENERATE_ATTEMPTS {
+		pin, err := randomPIN()
+		if err != nil {
+			return "", err
+		}
+
+		reserved, err := pm.store.SetNX(StoreKey(PIN_KEY_KIND, pin), "1", ttl)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return pin, nil
+		}
+	}
+
+	return "", fmt.Errorf("Cannot generate a unique PIN")
+}
+
+func (pm *StorePINManager) RemovePIN(pin string) error {
+	return pm.store.Del(StoreKey(PIN_KEY_KIND, pin))
+}
+
+// Expiry is left to the store, there is nothing to stop.
+func (pm *StorePINManager) Stop() {}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"math/big"
+	"strings"
 )
 
 var (
@@ -53,6 +54,14 @@ func GetSessionId() string {
 	return adj + "-" + noun + "-" + adjectives[adjId2.Int64()] + "-" + words[nounId2.Int64()]
 }
 
+// Random identifier for things that are never typed by a user, such as
+// websocket connections.
+func GetRandomId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 // Hashes a session id which should be used when saving or fetching session
 // data from the cache.
 func HashSessionId(sessionId string) string {
@@ -60,3 +69,33 @@ func HashSessionId(sessionId string) string {
 	h.Write([]byte(sessionId))
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+const (
+	// Every key the server writes besides session records starts with
+	// STORE_KEY_PREFIX and has its parts joined by STORE_KEY_SEPARATOR.
+	// Session ids cannot contain the separator, so no session id a client
+	// picks can name one of these keys.
+	STORE_KEY_PREFIX    = "hyperspace"
+	STORE_KEY_SEPARATOR = ":"
+
+	MAX_ID_SIZE = 64
+)
+
+// Builds the store key of an internal value, e.g. `StoreKey("pin", id)`.
+func StoreKey(kind string, parts ...string) string {
+	return strings.Join(append([]string{STORE_KEY_PREFIX, kind}, parts...), STORE_KEY_SEPARATOR)
+}
+
+// Reports whether a client chosen id, such as a session or room id, is
+// made of letters, digits, `-` and `_` only and is not too long.
+func ValidId(id string) bool {
+	if id == "" || len(id) > MAX_ID_SIZE {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,539 @@
+// Package signal is a Go client for the hyperspace session signaling
+// protocol served on `/ws/v1/session/`. It lets other programs create and
+// join sessions without reimplementing the websocket message format.
+//
+// A session is driven by two clients:
+//
+//	offerer:  CreateSession -> AwaitConfirmation -> FetchAnswer
+//	answerer: FetchOffer -> SendAnswer
+//
+// Both start with Hello, which negotiates the protocol version.
+//
+// An offerer whose connection drops can continue on a new Client with the
+// token returned by CreateSession, see Resume.
+//
+// A broadcast session, created with Offer.MaxReceivers set, is answered by
+// several receivers instead:
+//
+//	offerer:  CreateSession -> ApproveReceiver -> AwaitReceiverAnswer -> FetchReceiverAnswer
+//	receiver: JoinSession -> AwaitApproval -> SendAnswer
+//
+// Members of a room exchange RoomSignal messages with SendRoomSignal after
+// JoinRoom. Signals and presence changes of the other members arrive on
+// the handler of WithEventHandler.
+//
+// Requests are answered in order by the server, so a Client serializes
+// them; it is safe to call its methods from several goroutines.
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Receiver answers queued for AwaitReceiverAnswer. Further answers are
+// dropped, ListReceivers still reports them as "answered".
+const RECEIVER_QUEUE_SIZE = 64
+
+type Client struct {
+	conn            *websocket.Conn
+	replies         chan Message
+	confirmations   chan struct{}
+	receiverAnswers chan string
+	approvals       chan *SessionOffer
+	ended           chan struct{}
+	endErr          error
+	done            chan struct{}
+	readErr         error
+	writeMutex      sync.Mutex
+	requestMutex    sync.Mutex
+	// Type of the request waiting for a reply, empty when there is none.
+	pending             string
+	pendingMutex        sync.Mutex
+	onCandidate         func(*ICECandidate)
+	onReceiverCandidate func(string, *ICECandidate)
+	onEvent             func(Message)
+}
+
+type config struct {
+	origin              string
+	dialer              *websocket.Dialer
+	onCandidate         func(*ICECandidate)
+	onReceiverCandidate func(string, *ICECandidate)
+	onEvent             func(Message)
+}
+
+type Option func(*config)
+
+// Sets the Origin header of the websocket handshake. By default it is
+// derived from the server url, which matches the server allowed origin
+// when both are served from the same host.
+func WithOrigin(origin string) Option {
+	return func(c *config) {
+		c.origin = origin
+	}
+}
+
+func WithDialer(dialer *websocket.Dialer) Option {
+	return func(c *config) {
+		c.dialer = dialer
+	}
+}
+
+// Registers a callback for ICE candidates relayed from the other peer. A
+// nil candidate marks the end of the remote candidates. The callback runs
+// on the read loop and must not block.
+func WithCandidateHandler(handler func(*ICECandidate)) Option {
+	return func(c *config) {
+		c.onCandidate = handler
+	}
+}
+
+// Registers a callback for ICE candidates relayed from the receivers of a
+// broadcast session, along with the id of the receiver that sent them.
+// Without it they are passed to the handler of WithCandidateHandler.
+func WithReceiverCandidateHandler(handler func(receiverId string, candidate *ICECandidate)) Option {
+	return func(c *config) {
+		c.onReceiverCandidate = handler
+	}
+}
+
+// Registers a callback for server pushed notifications that are not
+// handled by the client itself, such as `answer_rejected`, and for `ok`
+// and `error` frames that answer no pending request, such as the error
+// for a rejected candidate. The callback runs on the read loop and must
+// not block.
+func WithEventHandler(handler func(Message)) Option {
+	return func(c *config) {
+		c.onEvent = handler
+	}
+}
+
+func Dial(ctx context.Context, server string, opts ...Option) (*Client, error) {
+	cfg := config{dialer: websocket.DefaultDialer}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.origin == "" {
+		var err error
+		if cfg.origin, err = originFromServer(server); err != nil {
+			return nil, err
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Origin", cfg.origin)
+	conn, _, err := cfg.dialer.DialContext(ctx, server, header)
+	if err != nil {
+		return nil, fmt.Errorf("signal: cannot connect to %s: %w", server, err)
+	}
+
+	client := &Client{
+		conn:                conn,
+		replies:             make(chan Message, 1),
+		confirmations:       make(chan struct{}, 1),
+		receiverAnswers:     make(chan string, RECEIVER_QUEUE_SIZE),
+		approvals:           make(chan *SessionOffer, 1),
+		ended:               make(chan struct{}),
+		done:                make(chan struct{}),
+		onCandidate:         cfg.onCandidate,
+		onReceiverCandidate: cfg.onReceiverCandidate,
+		onEvent:             cfg.onEvent,
+	}
+	go client.readLoop()
+
+	return client, nil
+}
+
+// Negotiates the protocol version and features with the server, it should
+// be the first request on a connection. `name` identifies the program to
+// the server. Fails with ErrUnsupported when the server no longer speaks
+// PROTOCOL_VERSION, the server then closes the connection.
+func (c *Client) Hello(ctx context.Context, name string) (*ServerHello, error) {
+	var hello ServerHello
+	request := helloRequest{Client: name, Version: PROTOCOL_VERSION, Features: Features}
+	if err := c.request(ctx, TypeHello, request, &hello); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
+
+// Publishes the offer, creating the session on the server. Returns the
+// token that lets a new connection take over the session with Resume.
+func (c *Client) CreateSession(ctx context.Context, offer Offer) (string, error) {
+	var resp offerResponse
+	if err := c.request(ctx, TypeOffer, offer, &resp); err != nil {
+		return "", err
+	}
+	return resp.ResumeToken, nil
+}
+
+// Reattaches this connection to a session created on a connection that
+// dropped. The returned token replaces the one used. When the session was
+// answered in the meantime, AwaitConfirmation returns right away.
+func (c *Client) Resume(ctx context.Context, sessionId string, resumeToken string) (*Resumed, error) {
+	var resumed Resumed
+	request := resumeRequest{SessionId: sessionId, ResumeToken: resumeToken}
+	if err := c.request(ctx, TypeResume, request, &resumed); err != nil {
+		return nil, err
+	}
+	if resumed.State == "answered" {
+		select {
+		case c.confirmations <- struct{}{}:
+		default:
+		}
+	}
+	return &resumed, nil
+}
+
+func (c *Client) FetchOffer(ctx context.Context, sessionId string) (*SessionOffer, error) {
+	var offer SessionOffer
+	if err := c.request(ctx, TypeGetOffer, sessionRequest{SessionId: sessionId}, &offer); err != nil {
+		return nil, err
+	}
+	return &offer, nil
+}
+
+// Answers the session offer. Returns the PIN the offerer needs to fetch
+// the answer.
+func (c *Client) SendAnswer(ctx context.Context, answer Answer) (string, error) {
+	var resp answerResponse
+	if err := c.request(ctx, TypeAnswer, answer, &resp); err != nil {
+		return "", err
+	}
+	return resp.Pin, nil
+}
+
+// Blocks until the server reports that a peer answered the session
+// created with CreateSession. Fails with ErrSessionClosed or
+// ErrSessionExpired when the session ends first.
+func (c *Client) AwaitConfirmation(ctx context.Context) error {
+	select {
+	case <-c.confirmations:
+		return nil
+	case <-c.ended:
+		return c.endErr
+	case <-c.done:
+		return c.closedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) FetchAnswer(ctx context.Context, sessionId string, pin string) (*Answer, error) {
+	var answer Answer
+	request := getAnswerRequest{SessionId: sessionId, Pin: pin}
+	if err := c.request(ctx, TypeGetAnswer, request, &answer); err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// Joins a broadcast session as a receiver and returns the receiver id.
+// Fails with ErrSessionFull once the session has all its receivers.
+func (c *Client) JoinSession(ctx context.Context, sessionId string) (string, error) {
+	var joined receiverMessage
+	if err := c.request(ctx, TypeJoin, sessionRequest{SessionId: sessionId}, &joined); err != nil {
+		return "", err
+	}
+	return joined.ReceiverId, nil
+}
+
+// Blocks until the offerer approved the receiver that joined with
+// JoinSession and returns the offer made for it.
+func (c *Client) AwaitApproval(ctx context.Context) (*SessionOffer, error) {
+	select {
+	case offer := <-c.approvals:
+		return offer, nil
+	case <-c.ended:
+		return nil, c.endErr
+	case <-c.done:
+		return nil, c.closedError()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Lists the receivers of a broadcast session created by this client.
+func (c *Client) ListReceivers(ctx context.Context, sessionId string) ([]Receiver, error) {
+	var resp receiversResponse
+	if err := c.request(ctx, TypeListReceivers, sessionRequest{SessionId: sessionId}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Receivers, nil
+}
+
+// Hands an offer made for the receiver named by offer.ReceiverId to that
+// receiver.
+func (c *Client) ApproveReceiver(ctx context.Context, offer Offer) error {
+	return c.request(ctx, TypeApproveReceiver, offer, nil)
+}
+
+// Blocks until a receiver of the broadcast session answered and returns
+// its id.
+func (c *Client) AwaitReceiverAnswer(ctx context.Context) (string, error) {
+	select {
+	case receiverId := <-c.receiverAnswers:
+		return receiverId, nil
+	case <-c.ended:
+		return "", c.endErr
+	case <-c.done:
+		return "", c.closedError()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *Client) FetchReceiverAnswer(ctx context.Context, sessionId string, receiverId string, pin string) (*Answer, error) {
+	var answer Answer
+	request := getAnswerRequest{SessionId: sessionId, Pin: pin, ReceiverId: receiverId}
+	if err := c.request(ctx, TypeGetAnswer, request, &answer); err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// Joins the room under the given member id and returns the members,
+// including this one.
+func (c *Client) JoinRoom(ctx context.Context, roomId string, memberId string) ([]string, error) {
+	var resp roomResponse
+	if err := c.request(ctx, TypeJoinRoom, roomRequest{RoomId: roomId, MemberId: memberId}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Members, nil
+}
+
+func (c *Client) LeaveRoom(ctx context.Context, roomId string) error {
+	return c.request(ctx, TypeLeaveRoom, roomRequest{RoomId: roomId}, nil)
+}
+
+func (c *Client) ListMembers(ctx context.Context, roomId string) ([]string, error) {
+	var resp roomResponse
+	if err := c.request(ctx, TypeListMembers, roomRequest{RoomId: roomId}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Members, nil
+}
+
+// Relays an offer, answer or candidate to the member named in signal.To.
+// `msgType` is one of TypeRoomOffer, TypeRoomAnswer and
+// TypeRoomIceCandidate.
+func (c *Client) SendRoomSignal(ctx context.Context, msgType string, signal RoomSignal) error {
+	return c.request(ctx, msgType, signal, nil)
+}
+
+// Ends the session for both peers.
+func (c *Client) CancelSession(ctx context.Context, sessionId string) error {
+	return c.request(ctx, TypeCancelSession, sessionRequest{SessionId: sessionId}, nil)
+}
+
+// Pushes the session deadline back and returns the new one. Fails with
+// ErrLimitReached once the session reached its maximum lifetime.
+func (c *Client) ExtendSession(ctx context.Context, sessionId string) (time.Time, error) {
+	var expiry SessionExpiry
+	if err := c.request(ctx, TypeExtendSession, sessionRequest{SessionId: sessionId}, &expiry); err != nil {
+		return time.Time{}, err
+	}
+	return expiry.ExpiresAt, nil
+}
+
+// Relays a local ICE candidate to the other peer. A nil candidate signals
+// the end of the local candidates.
+func (c *Client) SendCandidate(sessionId string, candidate *ICECandidate) error {
+	msgType := TypeIceCandidate
+	if candidate == nil {
+		msgType = TypeEndOfCandidates
+	}
+	return c.send(msgType, iceCandidateMessage{SessionId: sessionId, Candidate: candidate})
+}
+
+// Relays a local ICE candidate between the offerer and a receiver of a
+// broadcast session, in either direction.
+func (c *Client) SendReceiverCandidate(sessionId string, receiverId string, candidate *ICECandidate) error {
+	msgType := TypeIceCandidate
+	if candidate == nil {
+		msgType = TypeEndOfCandidates
+	}
+	return c.send(msgType, iceCandidateMessage{SessionId: sessionId, Candidate: candidate, ReceiverId: receiverId})
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+
+	for {
+		var msg Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.readErr = err
+			return
+		}
+
+		switch msg.Type {
+		case TypeOk, TypeError:
+			if !c.deliverReply(msg) && c.onEvent != nil {
+				c.onEvent(msg)
+			}
+		case TypeConfirmConnection:
+			var payload receiverMessage
+			json.Unmarshal(msg.Payload, &payload)
+			if payload.ReceiverId != "" {
+				select {
+				case c.receiverAnswers <- payload.ReceiverId:
+				default:
+				}
+				continue
+			}
+			select {
+			case c.confirmations <- struct{}{}:
+			default:
+			}
+		case TypeReceiverApproved:
+			var offer SessionOffer
+			if err := json.Unmarshal(msg.Payload, &offer); err != nil {
+				continue
+			}
+			select {
+			case c.approvals <- &offer:
+			default:
+			}
+		case TypeIceCandidate, TypeEndOfCandidates:
+			var payload iceCandidateMessage
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				continue
+			}
+			if payload.ReceiverId != "" && c.onReceiverCandidate != nil {
+				c.onReceiverCandidate(payload.ReceiverId, payload.Candidate)
+			} else if c.onCandidate != nil {
+				c.onCandidate(payload.Candidate)
+			}
+		case TypeSessionClosed:
+			var payload SessionClosed
+			json.Unmarshal(msg.Payload, &payload)
+			c.end(fmt.Errorf("%w: %s", ErrSessionClosed, payload.Reason))
+			if c.onEvent != nil {
+				c.onEvent(msg)
+			}
+		case TypeSessionExpired:
+			c.end(ErrSessionExpired)
+			if c.onEvent != nil {
+				c.onEvent(msg)
+			}
+		default:
+			if c.onEvent != nil {
+				c.onEvent(msg)
+			}
+		}
+	}
+}
+
+// Records why the session ended, only the first reason is kept.
+func (c *Client) end(err error) {
+	select {
+	case <-c.ended:
+	default:
+		c.endErr = err
+		close(c.ended)
+	}
+}
+
+func (c *Client) send(msgType string, payload any) error {
+	payloadRaw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.conn.WriteJSON(Message{Type: msgType, Payload: payloadRaw})
+}
+
+// Sends a request and decodes the `ok` payload of the reply into `out`.
+// `error` replies are returned as a *ServerError.
+func (c *Client) request(ctx context.Context, msgType string, payload any, out any) error {
+	c.requestMutex.Lock()
+	defer c.requestMutex.Unlock()
+
+	c.setPending(msgType)
+	defer c.setPending("")
+	if err := c.send(msgType, payload); err != nil {
+		return err
+	}
+
+	var reply Message
+	select {
+	case reply = <-c.replies:
+	case <-c.done:
+		return c.closedError()
+	case <-ctx.Done():
+		// The reply may still arrive and would be taken as the answer to
+		// the next request, so the connection cannot be reused.
+		c.conn.Close()
+		return ctx.Err()
+	}
+
+	switch reply.Type {
+	case TypeOk:
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(reply.Payload, out)
+	default:
+		var errResp errorResponse
+		json.Unmarshal(reply.Payload, &errResp)
+		return newServerError(errResp)
+	}
+}
+
+func (c *Client) setPending(msgType string) {
+	c.pendingMutex.Lock()
+	c.pending = msgType
+	c.pendingMutex.Unlock()
+}
+
+// Hands a reply to the pending request. Replies nobody waits for, such as
+// the error for a rejected candidate, are left to the caller. Servers that
+// do not echo `replyTo` are matched by order alone.
+func (c *Client) deliverReply(msg Message) bool {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	if c.pending == "" || (msg.ReplyTo != "" && msg.ReplyTo != c.pending) {
+		return false
+	}
+	select {
+	case c.replies <- msg:
+		c.pending = ""
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) closedError() error {
+	return fmt.Errorf("%w: %v", ErrClosed, c.readErr)
+}
+
+// The server only accepts sockets from its allowed origin, which matches
+// the http(s) counterpart of the websocket URL.
+func originFromServer(server string) (string, error) {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("signal: invalid server url: %w", err)
+	}
+
+	scheme := "http"
+	if serverURL.Scheme == "wss" {
+		scheme = "https"
+	}
+	return scheme + "://" + serverURL.Host, nil
+}
@@ -0,0 +1,82 @@
+package signal
+
+import (
+	"errors"
+)
+
+var (
+	ErrClosed          = errors.New("signal: connection closed")
+	ErrSessionNotFound = errors.New("signal: session not found")
+	ErrInvalidPIN      = errors.New("signal: invalid PIN")
+	ErrAnswerNotFound  = errors.New("signal: answer not found")
+	ErrPeerNotFound    = errors.New("signal: peer not found")
+	ErrActiveSession   = errors.New("signal: connection already has an active session")
+	ErrPINLocked       = errors.New("signal: too many PIN attempts")
+	ErrPINExpired      = errors.New("signal: PIN expired")
+	ErrSessionDone     = errors.New("signal: session already completed")
+	ErrSessionClosed   = errors.New("signal: session closed")
+	ErrSessionExpired  = errors.New("signal: session expired")
+	ErrInvalidState    = errors.New("signal: request not allowed in the current session state")
+	ErrBadSignature    = errors.New("signal: signature rejected")
+	ErrReplayed        = errors.New("signal: message rejected as a replay")
+	ErrLimitReached    = errors.New("signal: session limit reached")
+	ErrSessionFull     = errors.New("signal: session has no room for another receiver")
+	ErrInvalidToken    = errors.New("signal: invalid resume token")
+	ErrUnsupported     = errors.New("signal: protocol version not supported by the server")
+	ErrConflict        = errors.New("signal: session changed by another request, retry")
+	ErrUnsigned        = errors.New("signal: offer or answer is not signed")
+	ErrNoFeature       = errors.New("signal: feature not negotiated, call Hello first")
+)
+
+// Server error codes that map to a known sentinel error.
+var serverCodes = map[string]error{
+	CodePINLocked:       ErrPINLocked,
+	CodePINExpired:      ErrPINExpired,
+	CodeSessionClosed:   ErrSessionClosed,
+	CodeSessionExpired:  ErrSessionExpired,
+	CodeInvalidState:    ErrInvalidState,
+	CodeBadSignature:    ErrBadSignature,
+	CodeReplayed:        ErrReplayed,
+	CodeLimitReached:    ErrLimitReached,
+	CodeInvalidToken:    ErrInvalidToken,
+	CodeUnsupported:     ErrUnsupported,
+	CodeConflict:        ErrConflict,
+	CodeFeatureRequired: ErrNoFeature,
+}
+
+// Server error messages that map to a known sentinel error. They take
+// precedence over the code, which is shared by several messages.
+var serverErrors = map[string]error{
+	"Session not found":             ErrSessionNotFound,
+	"Invalid PIN":                   ErrInvalidPIN,
+	"Answer not found":              ErrAnswerNotFound,
+	"Peer connection not found":     ErrPeerNotFound,
+	"Already has an active session": ErrActiveSession,
+	"Session already completed":     ErrSessionDone,
+	"Session is full":               ErrSessionFull,
+}
+
+// ServerError is returned when the server replies with an `error` message.
+// It unwraps to one of the sentinel errors when the message is known, so
+// callers can use errors.Is.
+type ServerError struct {
+	Message string
+	Code    string
+	Err     error
+}
+
+func newServerError(resp errorResponse) *ServerError {
+	err, ok := serverErrors[resp.Message]
+	if !ok {
+		err = serverCodes[resp.Code]
+	}
+	return &ServerError{Message: resp.Message, Code: resp.Code, Err: err}
+}
+
+func (e *ServerError) Error() string {
+	return "signal: server error: " + e.Message
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
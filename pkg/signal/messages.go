@@ -0,0 +1,242 @@
+package signal
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Highest protocol version spoken by this package, announced with Hello.
+const PROTOCOL_VERSION = 1
+
+// Optional protocol features this package supports.
+var Features = []string{"trickle_ice", "signatures", "resume", "extend_session", "broadcast", "rooms"}
+
+// Message types of the `/ws/v1/session/` protocol.
+const (
+	TypeHello             = "hello"
+	TypeOffer             = "offer"
+	TypeGetOffer          = "get_offer"
+	TypeAnswer            = "answer"
+	TypeError             = "error"
+	TypeOk                = "ok"
+	TypeGetAnswer         = "get_answer"
+	TypeConfirmConnection = "confirm_connection"
+	TypeIceCandidate      = "ice_candidate"
+	TypeEndOfCandidates   = "end_of_candidates"
+	TypeAnswerRejected    = "answer_rejected"
+	TypeCancelSession     = "cancel_session"
+	TypeSessionClosed     = "session_closed"
+	TypeExtendSession     = "extend_session"
+	TypeSessionExpiring   = "session_expiring"
+	TypeSessionExpired    = "session_expired"
+	TypeSessionExtended   = "session_extended"
+	TypeResume            = "resume"
+	TypeJoin              = "join"
+	TypeReceiverJoined    = "receiver_joined"
+	TypeListReceivers     = "list_receivers"
+	TypeApproveReceiver   = "approve_receiver"
+	TypeReceiverApproved  = "receiver_approved"
+	TypeReceiverLeft      = "receiver_left"
+	TypeJoinRoom          = "join_room"
+	TypeLeaveRoom         = "leave_room"
+	TypeListMembers       = "list_members"
+	TypeMemberJoined      = "member_joined"
+	TypeMemberLeft        = "member_left"
+	TypeRoomOffer         = "room_offer"
+	TypeRoomAnswer        = "room_answer"
+	TypeRoomIceCandidate  = "room_ice_candidate"
+)
+
+// Codes attached to `error` messages.
+const (
+	CodePINLocked       = "pin_locked"
+	CodePINExpired      = "pin_expired"
+	CodeSessionClosed   = "session_closed"
+	CodeSessionExpired  = "session_expired"
+	CodeInvalidState    = "invalid_state"
+	CodeBadSignature    = "invalid_signature"
+	CodeReplayed        = "replayed"
+	CodeLimitReached    = "limit_reached"
+	CodeInvalidToken    = "invalid_resume_token"
+	CodeUnsupported     = "unsupported_version"
+	CodeConflict        = "conflict"
+	CodeFeatureRequired = "feature_not_negotiated"
+)
+
+// Message is the envelope of every frame exchanged with the server.
+type Message struct {
+	Payload json.RawMessage `json:"payload"`
+	Type    string          `json:"type"`
+	// Type of the message an `ok` or `error` frame answers.
+	ReplyTo string `json:"replyTo,omitempty"`
+}
+
+// Offer published by the peer creating a session. SDPs are the base64
+// encoded JSON session descriptions used by the browser client.
+type Offer struct {
+	SessionId string `json:"sessionId"`
+	OfferSDP  string `json:"offerSDP"`
+	PubKey    string `json:"pubKey"`
+	// Set by Sign to the public key of the signer.
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature,omitempty"`
+	// Requested session lifetime in seconds, the server default when zero.
+	TTL int `json:"ttl,omitempty"`
+	// Number of receivers accepted by a broadcast session, zero for a
+	// regular session.
+	MaxReceivers int `json:"maxReceivers,omitempty"`
+	// Receiver an offer of ApproveReceiver is meant for.
+	ReceiverId string `json:"receiverId,omitempty"`
+}
+
+// Offer data returned to a peer joining a session. The signature fields
+// are set when the offerer signed it, see Verify.
+type SessionOffer struct {
+	OfferSDP   string `json:"offerSDP"`
+	PubKey     string `json:"pubKey"`
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+type Answer struct {
+	SessionId string `json:"sessionId"`
+	AnswerSDP string `json:"answerSDP"`
+	PubKey    string `json:"pubKey"`
+	// Set by Sign to the public key of the signer.
+	SigningKey string `json:"signingKey,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Signature  string `json:"signature,omitempty"`
+	// Set by the receivers of a broadcast session.
+	ReceiverId string `json:"receiverId,omitempty"`
+}
+
+// ICECandidate mirrors the browser `RTCIceCandidateInit`.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// Pushed when the other peer cancelled the session or disconnected.
+type SessionClosed struct {
+	SessionId string `json:"sessionId"`
+	Reason    string `json:"reason"`
+}
+
+// Deadline of a session, pushed with `session_expiring` and
+// `session_extended`. `session_expired` leaves ExpiresAt empty.
+type SessionExpiry struct {
+	SessionId string    `json:"sessionId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Reply to Resume. State is the session state when the peer came back,
+// e.g. "answered" when the answer arrived while it was away.
+type Resumed struct {
+	SessionId   string `json:"sessionId"`
+	Role        string `json:"role"`
+	State       string `json:"state"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// Receiver of a broadcast session, pushed to the offerer with
+// `receiver_joined` and `receiver_left`.
+type Receiver struct {
+	Id    string `json:"receiverId"`
+	State string `json:"state,omitempty"`
+}
+
+// Offer, answer or ICE candidate exchanged between two room members with
+// SendRoomSignal. Relayed signals are pushed as events with From set to
+// the sending member.
+type RoomSignal struct {
+	RoomId    string        `json:"roomId"`
+	From      string        `json:"from,omitempty"`
+	To        string        `json:"to"`
+	OfferSDP  string        `json:"offerSDP,omitempty"`
+	AnswerSDP string        `json:"answerSDP,omitempty"`
+	PubKey    string        `json:"pubKey,omitempty"`
+	Candidate *ICECandidate `json:"candidate,omitempty"`
+}
+
+// Pushed with `member_joined` and `member_left`.
+type MemberEvent struct {
+	RoomId   string `json:"roomId"`
+	MemberId string `json:"memberId"`
+}
+
+type roomRequest struct {
+	RoomId   string `json:"roomId"`
+	MemberId string `json:"memberId,omitempty"`
+}
+
+type roomResponse struct {
+	Members []string `json:"members"`
+}
+
+type receiversResponse struct {
+	Receivers []Receiver `json:"receivers"`
+}
+
+type receiverMessage struct {
+	ReceiverId string `json:"receiverId"`
+}
+
+// Reply to Hello. Durations of the limits are in seconds, sizes in bytes.
+type ServerHello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Limits   struct {
+		SessionTTL         int `json:"sessionTTL"`
+		MaxSessionLifetime int `json:"maxSessionLifetime"`
+		PINTTL             int `json:"pinTTL"`
+		MaxMessageSize     int `json:"maxMessageSize"`
+		MaxReceivers       int `json:"maxReceivers"`
+		MaxRoomMembers     int `json:"maxRoomMembers"`
+	} `json:"limits"`
+}
+
+type helloRequest struct {
+	Client   string   `json:"client"`
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+type sessionRequest struct {
+	SessionId string `json:"sessionId"`
+}
+
+type offerResponse struct {
+	Message     string `json:"message"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+type resumeRequest struct {
+	SessionId   string `json:"sessionId"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+type answerResponse struct {
+	Message string `json:"message"`
+	Pin     string `json:"pin"`
+}
+
+type getAnswerRequest struct {
+	SessionId  string `json:"sessionId"`
+	Pin        string `json:"pin"`
+	ReceiverId string `json:"receiverId,omitempty"`
+}
+
+type iceCandidateMessage struct {
+	SessionId  string        `json:"sessionId"`
+	Candidate  *ICECandidate `json:"candidate,omitempty"`
+	ReceiverId string        `json:"receiverId,omitempty"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
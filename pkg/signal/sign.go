@@ -0,0 +1,268 @@
+package signal
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Public signing key in the JWK shape the server reads from `signingKey`.
+type signingJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Signs the offer and sets SigningKey to the public key of the signer. The
+// signer must not be the ECDH key advertised in `PubKey`. The public key and
+// the timestamp have to be set beforehand since they are part of the signed
+// payload.
+func (o *Offer) Sign(signer crypto.Signer) error {
+	signingKey, err := ExportSigningKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	signature, err := sign(signer, SignedPayload(o.SessionId, o.OfferSDP, o.PubKey, o.Timestamp))
+	if err != nil {
+		return err
+	}
+	o.SigningKey = signingKey
+	o.Signature = signature
+	return nil
+}
+
+// Signs the answer and sets SigningKey to the public key of the signer,
+// see Offer.Sign.
+func (a *Answer) Sign(signer crypto.Signer) error {
+	signingKey, err := ExportSigningKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	signature, err := sign(signer, SignedPayload(a.SessionId, a.AnswerSDP, a.PubKey, a.Timestamp))
+	if err != nil {
+		return err
+	}
+	a.SigningKey = signingKey
+	a.Signature = signature
+	return nil
+}
+
+// ExportSigningKey encodes an ECDSA P-256/P-384 or Ed25519 public key as
+// the base64 JWK JSON expected in `signingKey`.
+func ExportSigningKey(key crypto.PublicKey) (string, error) {
+	var jwk signingJWK
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		params := key.Curve.Params()
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384():
+		default:
+			return "", fmt.Errorf("signal: unsupported curve %s", params.Name)
+		}
+		coordSize := (params.BitSize + 7) / 8
+		jwk = signingJWK{
+			Crv: params.Name,
+			Kty: "EC",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, coordSize))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, coordSize))),
+		}
+	case ed25519.PublicKey:
+		jwk = signingJWK{Crv: "Ed25519", Kty: "OKP", X: base64.RawURLEncoding.EncodeToString(key)}
+	default:
+		return "", fmt.Errorf("signal: unsupported signing key %T", key)
+	}
+
+	jwkRaw, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(jwkRaw), nil
+}
+
+// Checks that the offer fetched for the session was signed by the key in
+// SigningKey. Compare Fingerprint(SigningKey) with the one the offerer sees
+// to make sure the server did not swap the keys. Fails with ErrUnsigned
+// when the offerer did not sign it.
+func (o *SessionOffer) Verify(sessionId string) error {
+	if o.Signature == "" {
+		return ErrUnsigned
+	}
+	return Verify(o.SigningKey, SignedPayload(sessionId, o.OfferSDP, o.PubKey, o.Timestamp), o.Signature)
+}
+
+// Checks that the answer was signed by the key in SigningKey, see
+// SessionOffer.Verify.
+func (a *Answer) Verify() error {
+	if a.Signature == "" {
+		return ErrUnsigned
+	}
+	return Verify(a.SigningKey, SignedPayload(a.SessionId, a.AnswerSDP, a.PubKey, a.Timestamp), a.Signature)
+}
+
+// SignedPayload returns the bytes the signature of an offer or answer
+// covers. The ECDH public key is part of it so it cannot be swapped without
+// breaking the signature.
+func SignedPayload(sessionId, sdp, pubKey, timestamp string) []byte {
+	return []byte(sessionId + "\n" + sdp + "\n" + pubKey + "\n" + timestamp)
+}
+
+// Verify checks a base64 signature over payload against a signing key
+// exported with ExportSigningKey or by WebCrypto. ECDSA signatures may be
+// raw r||s, as WebCrypto produces them, or ASN.1 DER. Fails with
+// ErrBadSignature.
+func Verify(signingKey string, payload []byte, signature string) error {
+	signatureRaw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: invalid encoding", ErrBadSignature)
+	}
+	jwk, err := parseSigningKey(signingKey)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		digest := sha256.Sum256(payload)
+		return verifyECDSA(jwk, ecdh.P256(), elliptic.P256(), digest[:], signatureRaw)
+	case jwk.Kty == "EC" && jwk.Crv == "P-384":
+		digest := sha512.Sum384(payload)
+		return verifyECDSA(jwk, ecdh.P384(), elliptic.P384(), digest[:], signatureRaw)
+	default:
+		key, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: invalid Ed25519 key", ErrBadSignature)
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), payload, signatureRaw) {
+			return fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+		}
+		return nil
+	}
+}
+
+// Fingerprint returns a short, human comparable digest of a signing key,
+// independent of how its JWK was serialized.
+func Fingerprint(signingKey string) (string, error) {
+	jwk, err := parseSigningKey(signingKey)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(jwk.Kty + "\n" + jwk.Crv + "\n" + jwk.X + "\n" + jwk.Y))
+
+	encoded := hex.EncodeToString(digest[:16])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+func parseSigningKey(signingKey string) (signingJWK, error) {
+	var jwk signingJWK
+	jwkRaw, err := base64.StdEncoding.DecodeString(signingKey)
+	if err != nil {
+		return jwk, fmt.Errorf("%w: invalid key encoding", ErrBadSignature)
+	}
+	if err := json.Unmarshal(jwkRaw, &jwk); err != nil {
+		return jwk, fmt.Errorf("%w: invalid key", ErrBadSignature)
+	}
+
+	switch {
+	case jwk.Kty == "EC" && (jwk.Crv == "P-256" || jwk.Crv == "P-384"):
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+	default:
+		return jwk, fmt.Errorf("%w: unsupported key %s/%s", ErrBadSignature, jwk.Kty, jwk.Crv)
+	}
+	return jwk, nil
+}
+
+func verifyECDSA(jwk signingJWK, curve ecdh.Curve, params elliptic.Curve, digest []byte, signature []byte) error {
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return fmt.Errorf("%w: invalid key", ErrBadSignature)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return fmt.Errorf("%w: invalid key", ErrBadSignature)
+	}
+
+	// Validates that the point is on the curve.
+	point := append([]byte{0x04}, x...)
+	point = append(point, y...)
+	if _, err := curve.NewPublicKey(point); err != nil {
+		return fmt.Errorf("%w: invalid key", ErrBadSignature)
+	}
+	key := &ecdsa.PublicKey{Curve: params, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	coordSize := (params.Params().BitSize + 7) / 8
+	if len(signature) == 2*coordSize {
+		r := new(big.Int).SetBytes(signature[:coordSize])
+		s := new(big.Int).SetBytes(signature[coordSize:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+		}
+		return nil
+	}
+	if !ecdsa.VerifyASN1(key, digest, signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+	}
+	return nil
+}
+
+// ECDSA keys sign the SHA-256 (P-256) or SHA-384 (P-384) digest of the
+// payload, Ed25519 keys sign the payload itself.
+func sign(signer crypto.Signer, payload []byte) (string, error) {
+	var signature []byte
+	var err error
+
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			digest := sha256.Sum256(payload)
+			signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		case elliptic.P384():
+			digest := sha512.Sum384(payload)
+			signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA384)
+		default:
+			return "", fmt.Errorf("signal: unsupported curve %s", key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		signature, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		return "", fmt.Errorf("signal: unsupported signing key %T", key)
+	}
+	if err != nil {
+		return "", err
+	}
+	if key, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		// Browsers only verify raw r||s signatures.
+		if signature, err = rawECDSA(signature, (key.Curve.Params().BitSize+7)/8); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func rawECDSA(signature []byte, coordSize int) ([]byte, error) {
+	var parsed struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &parsed); err != nil {
+		return nil, fmt.Errorf("signal: invalid ECDSA signature: %w", err)
+	}
+	raw := make([]byte, 2*coordSize)
+	parsed.R.FillBytes(raw[:coordSize])
+	parsed.S.FillBytes(raw[coordSize:])
+	return raw, nil
+}
@@ -15,10 +15,76 @@ export async function importPubKey(pubKey: string): Promise<CryptoKey> {
   }
 }
 
+/**
+ * Checks the signature a peer made over its offer or answer, see
+ * `Identity.sign`. Only the ECDSA P-384 keys browsers and the CLI use are
+ * supported.
+ * @param signingKey The base64 JWK the peer sent as `signingKey`
+ */
+export async function verifyPeerSignature(
+  signingKey: string,
+  sessionId: string,
+  sdp: string,
+  pubKey: string,
+  timestamp: string,
+  signature: string,
+): Promise<boolean> {
+  try {
+    const key = await window.crypto.subtle.importKey(
+      "jwk",
+      JSON.parse(atob(signingKey)),
+      { name: "ECDSA", namedCurve: "P-384" },
+      false,
+      ["verify"],
+    );
+    return await window.crypto.subtle.verify(
+      { name: "ECDSA", hash: "SHA-384" },
+      key,
+      Uint8Array.from(atob(signature), (c) => c.charCodeAt(0)),
+      signedPayload(sessionId, sdp, pubKey, timestamp),
+    );
+  } catch (error) {
+    console.error("JWK KEY: Could not verify peer signature", error);
+    return false;
+  }
+}
+
+/**
+ * Short digest of a signing key, the same one the CLI prints, for
+ * comparing keys out of band.
+ */
+export async function fingerprint(signingKey: string): Promise<string> {
+  const jwk = JSON.parse(atob(signingKey));
+  const digest = await window.crypto.subtle.digest(
+    "SHA-256",
+    new TextEncoder().encode(
+      [jwk.kty, jwk.crv, jwk.x, jwk.y ?? ""].join("\n"),
+    ),
+  );
+  const hex = Array.from(new Uint8Array(digest).slice(0, 16), (b) =>
+    b.toString(16).padStart(2, "0"),
+  ).join("");
+  return hex.match(/.{4}/g)!.join(" ");
+}
+
+function signedPayload(
+  sessionId: string,
+  sdp: string,
+  pubKey: string,
+  timestamp: string,
+): Uint8Array {
+  return new TextEncoder().encode(
+    [sessionId, sdp, pubKey, timestamp].join("\n"),
+  );
+}
+
 export class Identity {
   private sharedSecret: CryptoKey | null = null;
 
-  private constructor(private readonly _keyPair: CryptoKeyPair) {}
+  private constructor(
+    private readonly _keyPair: CryptoKeyPair,
+    private readonly _signingKeyPair: CryptoKeyPair,
+  ) {}
 
   static async init(): Promise<Identity> {
     let newKeyPair = await window.crypto.subtle.generateKey(
@@ -26,14 +92,47 @@ export class Identity {
       true,
       ["deriveKey"],
     );
-    return new Identity(newKeyPair);
+    // ECDH keys cannot sign, the offer and answer are signed with a key
+    // pair of their own.
+    let signingKeyPair = await window.crypto.subtle.generateKey(
+      { name: "ECDSA", namedCurve: "P-384" },
+      true,
+      ["sign", "verify"],
+    );
+    return new Identity(newKeyPair, signingKeyPair);
   }
 
   async exportPubKey(): Promise<string> {
-    const exported = await window.crypto.subtle.exportKey(
-      "jwk",
-      this._keyPair.publicKey,
+    return Identity.exportKey(this._keyPair.publicKey);
+  }
+
+  /** Public key the server verifies `signature` with, sent as `signingKey` */
+  async exportSigningKey(): Promise<string> {
+    return Identity.exportKey(this._signingKeyPair.publicKey);
+  }
+
+  /**
+   * Signs `sessionId + "\n" + sdp + "\n" + pubKey + "\n" + timestamp` as
+   * the server and the peer expect for offers and answers.
+   * @returns The base64 raw r||s signature
+   */
+  async sign(
+    sessionId: string,
+    sdp: string,
+    pubKey: string,
+    timestamp: string,
+  ): Promise<string> {
+    const signature = await window.crypto.subtle.sign(
+      { name: "ECDSA", hash: "SHA-384" },
+      this._signingKeyPair.privateKey,
+      signedPayload(sessionId, sdp, pubKey, timestamp),
     );
+
+    return btoa(String.fromCharCode(...new Uint8Array(signature)));
+  }
+
+  private static async exportKey(key: CryptoKey): Promise<string> {
+    const exported = await window.crypto.subtle.exportKey("jwk", key);
     const jsonExported = JSON.stringify(exported, null, " ");
 
     return btoa(jsonExported);
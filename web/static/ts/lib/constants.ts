@@ -12,6 +12,18 @@ export const ICE_SERVERS: RTCConfiguration = {
  */
 export const MAX_CHUNK_SIZE = 512 * 1024; // 512KB
 
+/**
+ * Signaling protocol version and features announced with `hello`
+ */
+export const PROTOCOL_VERSION = 1;
+export const PROTOCOL_FEATURES = ["trickle_ice", "resume"];
+
+/**
+ * Reconnects attempted to resume a session after the signaling socket drops
+ */
+export const MAX_RESUME_ATTEMPTS = 5;
+export const RESUME_DELAY = 1000; // 1s
+
 export enum PeerState {
   IDLE,
   OFFER_CREATED,
@@ -37,6 +49,7 @@ export enum PeerEvent {
   TRANSFER_INITIATED = "transferInitiated",
   PEER_STATUS_CHANGED = "peerStatusChanged",
   CANCEL_TRANSFER = "cancelTransfer",
+  ICE_CANDIDATE = "iceCandidate",
 }
 
 export enum SignalingEvent {
@@ -46,6 +59,9 @@ export enum SignalingEvent {
   PIN_RECEIVED = "pin_received",
   OFFER_FETCHED = "offerFetched",
   REQUEST_ANSWER_WITH_PIN = "request_answer_with_pin",
+  REMOTE_CANDIDATE = "remote_candidate",
+  SESSION_CLOSED = "session_closed",
+  SESSION_EXPIRED = "session_expired",
 }
 
 export enum FileStatus {
@@ -64,6 +80,13 @@ export enum SignalingState {
   WAITING_FOR_ANSWER,
   GATHERING,
   ANSWER_SENT,
+  RESUMING,
+}
+
+/** Codes attached to signaling `error` messages */
+export enum ErrorCode {
+  PIN_LOCKED = "pin_locked",
+  UNSUPPORTED_VERSION = "unsupported_version",
 }
 
 export enum PeerMessageType {
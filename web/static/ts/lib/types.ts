@@ -1,24 +1,61 @@
 import { PeerMessageType } from "./constants";
 
 export interface SessionResponse<T> {
-  type: "ok" | "error" | "confirm_connection";
+  type:
+    | "ok"
+    | "error"
+    | "confirm_connection"
+    | "ice_candidate"
+    | "end_of_candidates"
+    | "answer_rejected"
+    | "session_closed"
+    | "session_expiring"
+    | "session_expired";
   payload: T;
+  /** Type of the request an `ok` or `error` answers */
+  replyTo?: string;
 }
 
 export interface Response {
   message: string;
+  code?: string;
 }
 
-export interface OfferDataResponse {
-  offerSDP: string;
+/** Acknowledgement of an offer, the token is used to resume the session */
+export interface OfferResponse extends Response {
+  resumeToken?: string;
+}
+
+/** Reply to `hello`, durations are in seconds and sizes in bytes */
+export interface HelloResponse {
+  version: number;
+  features: string[];
+  limits: {
+    sessionTTL: number;
+    maxSessionLifetime: number;
+    pinTTL: number;
+    maxMessageSize: number;
+    maxReceivers: number;
+    maxRoomMembers: number;
+  };
+}
+
+/** Keys and signature a peer sends with its offer or answer */
+export interface SignedData {
   pubKey: string;
+  signingKey?: string;
+  timestamp?: string;
+  signature?: string;
 }
 
-export interface AnswerDataResponse {
+export interface OfferDataResponse extends SignedData {
+  offerSDP: string;
+}
+
+export interface AnswerDataResponse extends SignedData {
   answerSDP: string;
   sessionId: string;
   timestamp: string;
-  pubKey: string;
 }
 
 /** Raw message structure of a message sent through the data channel between peers */
@@ -62,6 +99,30 @@ export interface SDPEventMessage {
   sdp: RTCSessionDescriptionInit;
 }
 
+/** A trickled ICE candidate, `null` once gathering is complete */
+export interface IceCandidateEvent {
+  candidate: RTCIceCandidateInit | null;
+}
+
+export interface IceCandidatePayload {
+  sessionId: string;
+  candidate?: RTCIceCandidateInit;
+}
+
+/** Reply to `resume`, with the state of the session taken over */
+export interface ResumeResponse {
+  sessionId: string;
+  role: "offerer" | "answerer";
+  state: string;
+  resumeToken: string;
+}
+
+/** Pushed when the other peer cancelled the session or disconnected */
+export interface SessionClosedPayload {
+  sessionId: string;
+  reason: "cancelled" | "peer_disconnected" | "pin_locked";
+}
+
 export interface PinReceivedEvent {
   pin: string;
 }
@@ -17,6 +17,7 @@ import {
   handleSaveToDisk,
 } from "./handlers.js";
 import type {
+  IceCandidateEvent,
   InitPayload,
   PeerMessage,
   TransferSession,
@@ -45,6 +46,7 @@ export class WebRTCPeer {
   private state: PeerState = PeerState.IDLE;
   private transferSession: TransferSession | null = null;
   private currentChunkSize: number = 0;
+  private pendingCandidates: (RTCIceCandidateInit | null)[] = [];
 
   constructor(
     isOfferer: boolean = false,
@@ -63,31 +65,13 @@ export class WebRTCPeer {
       console.error("ICE ERROR:", event);
     };
 
-    this.peerConnection.onicegatheringstatechange = (event: Event) => {
-      if (this.peerConnection.iceGatheringState !== "complete") return;
-      switch (this.state) {
-        case PeerState.OFFER_CREATED:
-          peerEmitter.dispatchPeerEvent<SDPEventMessage>(
-            PeerEvent.OFFER_CREATED,
-            {
-              sdp: this.peerConnection.localDescription!,
-            },
-          );
-          this.state = PeerState.OFFER_SET;
-          break;
-        case PeerState.OFFER_ACCEPTED:
-          peerEmitter.dispatchPeerEvent<SDPEventMessage>(
-            PeerEvent.OFFER_ACCEPTED,
-            {
-              sdp: this.peerConnection.localDescription!,
-            },
-          );
-          this.state = PeerState.ANSWER_CREATED;
-          break;
-        default:
-          console.error("ICE ERROR: Unknown state", this.state);
-          break;
-      }
+    this.peerConnection.onicecandidate = (
+      event: RTCPeerConnectionIceEvent,
+    ) => {
+      peerEmitter.dispatchPeerEvent<IceCandidateEvent>(
+        PeerEvent.ICE_CANDIDATE,
+        { candidate: event.candidate ? event.candidate.toJSON() : null },
+      );
     };
 
     this.peerConnection.onconnectionstatechange = (
@@ -201,6 +185,11 @@ export class WebRTCPeer {
     } catch (error) {
       throw new Error("SDP ERROR: Cannot create new offer");
     }
+
+    peerEmitter.dispatchPeerEvent<SDPEventMessage>(PeerEvent.OFFER_CREATED, {
+      sdp: this.peerConnection.localDescription!,
+    });
+    this.state = PeerState.OFFER_SET;
   }
 
   public async acceptOffer(offer: RTCSessionDescriptionInit): Promise<void> {
@@ -210,6 +199,7 @@ export class WebRTCPeer {
     } catch (error) {
       throw new Error("SDP ERROR: Cannot set offer");
     }
+    await this.applyPendingCandidates();
   }
 
   public async acceptAnswer(answer: RTCSessionDescriptionInit): Promise<void> {
@@ -219,17 +209,53 @@ export class WebRTCPeer {
     } catch (error) {
       throw new Error("SDP ERROR: Cannot set answer");
     }
+    await this.applyPendingCandidates();
   }
 
   public async createAnswer(): Promise<RTCSessionDescriptionInit> {
     try {
       const answer = await this.peerConnection.createAnswer();
       await this.peerConnection.setLocalDescription(answer);
+      peerEmitter.dispatchPeerEvent<SDPEventMessage>(
+        PeerEvent.OFFER_ACCEPTED,
+        {
+          sdp: this.peerConnection.localDescription!,
+        },
+      );
+      this.state = PeerState.ANSWER_CREATED;
       return answer;
     } catch (error) {
       throw new Error("SDP ERROR: Cannot create new answer");
     }
   }
+
+  /**
+   * Applies a candidate trickled by the remote peer. Candidates received
+   * before the remote description is set are kept until it is.
+   * @param candidate The remote candidate, or `null` for end of candidates
+   */
+  public async addRemoteCandidate(
+    candidate: RTCIceCandidateInit | null,
+  ): Promise<void> {
+    if (this.peerConnection.remoteDescription === null) {
+      this.pendingCandidates.push(candidate);
+      return;
+    }
+
+    try {
+      await this.peerConnection.addIceCandidate(candidate ?? undefined);
+    } catch (error) {
+      console.error("ICE ERROR: Cannot add remote candidate", error);
+    }
+  }
+
+  private async applyPendingCandidates(): Promise<void> {
+    const pending = this.pendingCandidates;
+    this.pendingCandidates = [];
+    for (const candidate of pending) {
+      await this.addRemoteCandidate(candidate);
+    }
+  }
   private async resetPeer(): Promise<void> {
     this.transferSession = null;
     this.state = PeerState.CONNECTED;
@@ -1,13 +1,31 @@
-import { PeerEvent, SignalingEvent, SignalingState } from "./constants.js";
+import { fingerprint, verifyPeerSignature } from "./auth.js";
+import type { Identity } from "./auth.js";
+import {
+  ErrorCode,
+  MAX_RESUME_ATTEMPTS,
+  PeerEvent,
+  PROTOCOL_FEATURES,
+  PROTOCOL_VERSION,
+  RESUME_DELAY,
+  SignalingEvent,
+  SignalingState,
+} from "./constants.js";
 import {
   handleDisplayStatusChange,
   handleSessionResponseError,
 } from "./handlers.js";
 import type {
   AnswerDataResponse,
+  HelloResponse,
+  IceCandidateEvent,
+  IceCandidatePayload,
   OfferDataResponse,
+  OfferResponse,
   Response,
+  ResumeResponse,
+  SessionClosedPayload,
   SessionResponse,
+  SignedData,
 } from "./types.js";
 import { decodeSDP, encodeSDP } from "./utils.js";
 import { peerEmitter } from "./webrtc.js";
@@ -23,26 +41,94 @@ export const signallingEmitter = new SignallingEmitter();
 export class WSConnect {
   private client: WebSocket;
   private state: SignalingState = SignalingState.IDLE;
+  private pendingCandidates: (RTCIceCandidateInit | null)[] = [];
+  private sessionId: string | null = null;
+  /** Session of the pending `get_offer`, its reply does not carry the id */
+  private joiningSessionId: string | null = null;
+  private resumeToken: string | null = null;
+  private resumeState: SignalingState = SignalingState.IDLE;
+  private resumeAttempts = 0;
+  private closing = false;
+  private helloPending = false;
 
   constructor() {
-    this.client = new WebSocket((window as any).SERVER_CONFIG?.WS_URL || "");
-    this.client.onopen = () => {
-      signallingEmitter.dispatchPeerEvent(SignalingEvent.CONNECTED, {});
-    };
-    this.client.onerror = (event: Event) => {
+    this.client = this.connect();
+  }
+
+  private connect(): WebSocket {
+    const client = new WebSocket((window as any).SERVER_CONFIG?.WS_URL || "");
+    client.onopen = () => this.sendHello(client);
+    client.onerror = (event: Event) => {
+      if (this.state == SignalingState.RESUMING) return;
       handleDisplayStatusChange("Server Down");
       handleSessionResponseError(
         "Cannot create a new SafeFiles session due to a server error",
       );
     };
+    client.onclose = () => this.handleClose();
+
+    client.onmessage = (event: MessageEvent<string>) => {
+      const relayed = JSON.parse(event.data) as SessionResponse<any>;
+      if (
+        this.helloPending &&
+        (relayed.type == "ok" || relayed.type == "error")
+      ) {
+        this.handleHello(relayed as SessionResponse<HelloResponse | Response>);
+        return;
+      }
+      if (
+        relayed.replyTo == "ice_candidate" ||
+        relayed.replyTo == "end_of_candidates"
+      ) {
+        // Candidates are not acknowledged, a rejected one must not be
+        // taken as the reply to the pending request.
+        if (relayed.type == "error") {
+          console.error(
+            "ICE ERROR: Candidate rejected",
+            (relayed.payload as Response).message,
+          );
+        }
+        return;
+      }
+      if (
+        relayed.type == "ice_candidate" ||
+        relayed.type == "end_of_candidates"
+      ) {
+        const { candidate } = relayed.payload as IceCandidatePayload;
+        signallingEmitter.dispatchPeerEvent<IceCandidateEvent>(
+          SignalingEvent.REMOTE_CANDIDATE,
+          { candidate: candidate ?? null },
+        );
+        return;
+      }
+      if (relayed.type == "answer_rejected") {
+        handleSessionResponseError((relayed.payload as Response).message);
+        return;
+      }
+      if (relayed.type == "session_closed") {
+        signallingEmitter.dispatchPeerEvent<SessionClosedPayload>(
+          SignalingEvent.SESSION_CLOSED,
+          relayed.payload as SessionClosedPayload,
+        );
+        return;
+      }
+      if (relayed.type == "session_expiring") {
+        handleDisplayStatusChange("Session expires soon");
+        return;
+      }
+      if (relayed.type == "session_expired") {
+        signallingEmitter.dispatchPeerEvent(SignalingEvent.SESSION_EXPIRED, {});
+        return;
+      }
 
-    this.client.onmessage = (event: MessageEvent<string>) => {
       switch (this.state) {
         case SignalingState.OFFER_SENT:
           const message = JSON.parse(event.data) as SessionResponse<Response>;
           if (message.type == "error") {
             handleSessionResponseError(message.payload.message);
           } else if (message.type == "ok") {
+            this.resumeToken =
+              (message.payload as OfferResponse).resumeToken ?? null;
             this.state = SignalingState.WAITING_FOR_CONNECTION;
             handleDisplayStatusChange("Waiting for connection");
           }
@@ -67,21 +153,55 @@ export class WSConnect {
             );
           } else if (offerDataMsg.type == "ok") {
             const offerData = offerDataMsg.payload as OfferDataResponse;
-            const offerSDP = decodeSDP(offerData.offerSDP);
-            signallingEmitter.dispatchPeerEvent(SignalingEvent.OFFER_FETCHED, {
-              offerSDP,
-              pubKey: offerData.pubKey,
-            });
+            this.checkPeer(
+              this.joiningSessionId!,
+              offerData.offerSDP,
+              offerData,
+            )
+              .then(() => {
+                signallingEmitter.dispatchPeerEvent(
+                  SignalingEvent.OFFER_FETCHED,
+                  {
+                    offerSDP: decodeSDP(offerData.offerSDP),
+                    pubKey: offerData.pubKey,
+                  },
+                );
+              })
+              .catch(() => {
+                handleDisplayStatusChange("SafeFiles");
+                handleSessionResponseError("The offer signature is invalid");
+              });
           }
           break;
         case SignalingState.WAITING_FOR_ANSWER:
-          const answerData = JSON.parse(
-            event.data,
-          ) as SessionResponse<AnswerDataResponse>;
-          peerEmitter.dispatchPeerEvent(PeerEvent.ANSWER_CREATED, {
-            sdp: decodeSDP(answerData.payload.answerSDP),
-            pubKey: answerData.payload.pubKey,
-          });
+          const answerData = JSON.parse(event.data) as SessionResponse<
+            AnswerDataResponse | Response
+          >;
+          if (answerData.type == "error") {
+            const { message, code } = answerData.payload as Response;
+            if (code == ErrorCode.PIN_LOCKED) {
+              handleDisplayStatusChange("Session locked");
+              this.close();
+            }
+            handleSessionResponseError(message);
+            break;
+          }
+          if (answerData.type != "ok") break;
+          const answerPayload = answerData.payload as AnswerDataResponse;
+          this.checkPeer(
+            answerPayload.sessionId,
+            answerPayload.answerSDP,
+            answerPayload,
+          )
+            .then(() => {
+              peerEmitter.dispatchPeerEvent(PeerEvent.ANSWER_CREATED, {
+                sdp: decodeSDP(answerPayload.answerSDP),
+                pubKey: answerPayload.pubKey,
+              });
+            })
+            .catch(() => {
+              handleSessionResponseError("The answer signature is invalid");
+            });
 
           break;
         case SignalingState.ANSWER_SENT:
@@ -96,6 +216,32 @@ export class WSConnect {
             });
           }
           break;
+        case SignalingState.RESUMING:
+          const resumed = JSON.parse(event.data) as SessionResponse<
+            ResumeResponse | Response
+          >;
+          if (resumed.type == "error") {
+            this.resumeToken = null;
+            handleDisplayStatusChange("Session closed");
+            handleSessionResponseError((resumed.payload as Response).message);
+            break;
+          }
+          if (resumed.type != "ok") break;
+          const { resumeToken, state } = resumed.payload as ResumeResponse;
+          this.resumeToken = resumeToken;
+          this.resumeAttempts = 0;
+          this.state = this.resumeState;
+          this.flushCandidates(this.sessionId!);
+          if (
+            state == "answered" &&
+            this.state == SignalingState.WAITING_FOR_CONNECTION
+          ) {
+            signallingEmitter.dispatchPeerEvent(SignalingEvent.PROMPT_PIN, {});
+            this.state = SignalingState.WAITING_FOR_ANSWER;
+          } else if (this.state == SignalingState.WAITING_FOR_CONNECTION) {
+            handleDisplayStatusChange("Waiting for connection");
+          }
+          break;
         default: {
           handleDisplayStatusChange("Connection error");
           handleSessionResponseError("Cannot connect. Please refresh page.");
@@ -103,29 +249,111 @@ export class WSConnect {
         }
       }
     };
+
+    return client;
+  }
+
+  /**
+   * Reconnects and takes over the session with the resume token when the
+   * socket drops while the offerer waits for its peer.
+   */
+  private handleClose() {
+    const waiting =
+      this.state == SignalingState.WAITING_FOR_CONNECTION ||
+      this.state == SignalingState.WAITING_FOR_ANSWER;
+    if (this.closing || this.resumeToken === null) return;
+    if (!waiting && this.state != SignalingState.RESUMING) return;
+    if (this.resumeAttempts >= MAX_RESUME_ATTEMPTS) {
+      handleDisplayStatusChange("Server Down");
+      handleSessionResponseError("Lost the connection to the server");
+      return;
+    }
+
+    if (waiting) this.resumeState = this.state;
+    this.state = SignalingState.RESUMING;
+    this.resumeAttempts++;
+    handleDisplayStatusChange("Reconnecting");
+    setTimeout(() => {
+      this.client = this.connect();
+    }, RESUME_DELAY);
   }
 
-  public sendOffer(
+  /**
+   * Negotiates the protocol version, replies arrive in order so the first
+   * one on the socket answers it.
+   */
+  private sendHello(client: WebSocket) {
+    const payload = {
+      type: "hello",
+      payload: {
+        client: "safefiles-web",
+        version: PROTOCOL_VERSION,
+        features: PROTOCOL_FEATURES,
+      },
+    };
+
+    this.helloPending = true;
+    client.send(JSON.stringify(payload));
+  }
+
+  private handleHello(reply: SessionResponse<HelloResponse | Response>) {
+    this.helloPending = false;
+    if (reply.type == "error") {
+      const { message, code } = reply.payload as Response;
+      if (code == ErrorCode.UNSUPPORTED_VERSION) {
+        this.closing = true;
+        handleDisplayStatusChange("Update required");
+        handleSessionResponseError(
+          "This page is out of date. Please refresh page.",
+        );
+        return;
+      }
+      handleSessionResponseError(message);
+      return;
+    }
+
+    if (this.state == SignalingState.RESUMING) {
+      this.sendResume();
+      return;
+    }
+    signallingEmitter.dispatchPeerEvent(SignalingEvent.CONNECTED, {});
+  }
+
+  private sendResume() {
+    const payload = {
+      type: "resume",
+      payload: {
+        sessionId: this.sessionId,
+        resumeToken: this.resumeToken,
+      },
+    };
+
+    this.client.send(JSON.stringify(payload));
+  }
+
+  public async sendOffer(
     sdp: RTCSessionDescriptionInit,
     sessionId: string,
-    pubKey: string,
+    identity: Identity,
   ) {
+    const offerSDP = encodeSDP(sdp);
     const payload = {
       type: "offer",
       payload: {
         sessionId,
-        offerSDP: encodeSDP(sdp),
-        timestamp: new Date().toISOString(),
-        pubKey,
+        offerSDP,
+        ...(await this.signedFields(identity, sessionId, offerSDP)),
       },
     };
 
     this.client.send(JSON.stringify(payload));
     this.state = SignalingState.OFFER_SENT;
     handleDisplayStatusChange("Connecting to server");
+    this.flushCandidates(sessionId);
   }
 
   public getSessionData(sessionId: string) {
+    this.joiningSessionId = sessionId;
     const payload = {
       type: "get_offer",
       payload: {
@@ -138,24 +366,99 @@ export class WSConnect {
     handleDisplayStatusChange("Fetching session data");
   }
 
-  public sendAnswer(
+  public async sendAnswer(
     sdp: RTCSessionDescriptionInit,
     sessionId: string,
-    pubKey: string,
+    identity: Identity,
   ) {
+    const answerSDP = encodeSDP(sdp);
     const payload = {
       type: "answer",
       payload: {
         sessionId,
-        answerSDP: encodeSDP(sdp),
-        timestamp: new Date().toISOString(),
-        pubKey,
+        answerSDP,
+        ...(await this.signedFields(identity, sessionId, answerSDP)),
       },
     };
 
     this.client.send(JSON.stringify(payload));
     this.state = SignalingState.ANSWER_SENT;
     handleDisplayStatusChange("Connecting to peer");
+    this.flushCandidates(sessionId);
+  }
+
+  /**
+   * Rejects when the peer signed its offer or answer and the signature does
+   * not match. Unsigned ones are let through with a warning since their keys
+   * cannot be checked.
+   * @param sdp The encoded SDP, as received from the server
+   */
+  private async checkPeer(sessionId: string, sdp: string, peer: SignedData) {
+    if (!peer.signature || !peer.signingKey) {
+      console.warn("The peer did not sign its keys, they cannot be verified");
+      return;
+    }
+    const valid = await verifyPeerSignature(
+      peer.signingKey,
+      sessionId,
+      sdp,
+      peer.pubKey,
+      peer.timestamp ?? "",
+      peer.signature,
+    );
+    if (!valid) throw new Error("Invalid peer signature");
+    console.info("Peer key fingerprint:", await fingerprint(peer.signingKey));
+  }
+
+  /**
+   * Keys and signature proving the offer or answer comes from this peer.
+   * @param sdp The encoded SDP, as sent to the server
+   */
+  private async signedFields(
+    identity: Identity,
+    sessionId: string,
+    sdp: string,
+  ) {
+    const timestamp = new Date().toISOString();
+    const pubKey = await identity.exportPubKey();
+    const signingKey = await identity.exportSigningKey();
+    console.info("Your key fingerprint:", await fingerprint(signingKey));
+    return {
+      timestamp,
+      pubKey,
+      signingKey,
+      signature: await identity.sign(sessionId, sdp, pubKey, timestamp),
+    };
+  }
+
+  /**
+   * Relays a local ICE candidate to the peer through the server. Candidates
+   * gathered before the offer or answer went out are held back until then,
+   * since the server only relays for connections attached to a session.
+   * @param candidate The candidate, or `null` when gathering is complete
+   */
+  public sendCandidate(candidate: RTCIceCandidateInit | null) {
+    if (this.sessionId === null || this.state == SignalingState.RESUMING) {
+      this.pendingCandidates.push(candidate);
+      return;
+    }
+
+    const payload = {
+      type: candidate === null ? "end_of_candidates" : "ice_candidate",
+      payload: {
+        sessionId: this.sessionId,
+        ...(candidate === null ? {} : { candidate }),
+      },
+    };
+
+    this.client.send(JSON.stringify(payload));
+  }
+
+  private flushCandidates(sessionId: string) {
+    this.sessionId = sessionId;
+    const pending = this.pendingCandidates;
+    this.pendingCandidates = [];
+    pending.forEach((candidate) => this.sendCandidate(candidate));
   }
 
   public requestAnswer(pin: string, sessionId: string) {
@@ -172,7 +475,24 @@ export class WSConnect {
     handleDisplayStatusChange("Validating Pin");
   }
 
+  /** Ends the session for both peers before they are connected */
+  public cancelSession() {
+    if (this.sessionId === null || this.client.readyState != WebSocket.OPEN) {
+      return;
+    }
+
+    const payload = {
+      type: "cancel_session",
+      payload: {
+        sessionId: this.sessionId,
+      },
+    };
+
+    this.client.send(JSON.stringify(payload));
+  }
+
   public close() {
+    this.closing = true;
     this.client.close();
   }
 }
@@ -3,14 +3,17 @@ import { PeerEvent, PeerState, SignalingEvent } from "./lib/constants.js";
 import {
   handleCreateOffer,
   handleDisplayStatusChange,
+  handleSessionResponseError,
 } from "./lib/handlers.js";
 import type {
   CancelTransferEvent,
   FileUpdateEvent,
+  IceCandidateEvent,
   InitTransferMessage,
   PinReceivedEvent,
   ReceiveTransferMessage,
   SDPEventMessage,
+  SessionClosedPayload,
 } from "./lib/types.js";
 import { addFileDiv, getFileID } from "./lib/utils.js";
 import { peerEmitter, WebRTCPeer } from "./lib/webrtc.js";
@@ -78,16 +81,22 @@ peerEmitter.addEventListener(PeerEvent.OFFER_CREATED, async (event: Event) => {
   const sessionIdInput = document.getElementById(
     "sessionId",
   ) as HTMLInputElement;
-  let pubKey = await identity!.exportPubKey();
-  signallingChannel.sendOffer(detail.sdp, sessionIdInput.value, pubKey);
+  await signallingChannel.sendOffer(
+    detail.sdp,
+    sessionIdInput.value,
+    identity!,
+  );
   sessionStorage.setItem("SafeFiles-x-session", sessionIdInput.value);
 });
 
 peerEmitter.addEventListener(PeerEvent.OFFER_ACCEPTED, async (event: Event) => {
   const { detail } = event as CustomEvent<SDPEventMessage>;
   const sessionInput = document.getElementById("sessionId") as HTMLInputElement;
-  let pubKey = await identity!.exportPubKey();
-  signallingChannel.sendAnswer(detail.sdp, sessionInput.value, pubKey);
+  await signallingChannel.sendAnswer(
+    detail.sdp,
+    sessionInput.value,
+    identity!,
+  );
   sessionStorage.setItem("SafeFiles-x-session", sessionInput.value);
 });
 
@@ -166,10 +175,57 @@ signallingEmitter.addEventListener(
   },
 );
 
+peerEmitter.addEventListener(PeerEvent.ICE_CANDIDATE, (event: Event) => {
+  const { detail } = event as CustomEvent<IceCandidateEvent>;
+  signallingChannel.sendCandidate(detail.candidate);
+});
+
+signallingEmitter.addEventListener(
+  SignalingEvent.REMOTE_CANDIDATE,
+  async (event: Event) => {
+    const { detail } = event as CustomEvent<IceCandidateEvent>;
+    await localPeer!.addRemoteCandidate(detail.candidate);
+  },
+);
+
 signallingEmitter.addEventListener(SignalingEvent.CLOSE, () => {
   signallingChannel.close();
 });
 
+// Signaling only matters until the peers are connected, a session closed
+// after that does not affect the transfer.
+signallingEmitter.addEventListener(SignalingEvent.SESSION_CLOSED, (event) => {
+  const { detail } = event as CustomEvent<SessionClosedPayload>;
+  if (localPeer !== null && localPeer.getState() >= PeerState.CONNECTED) {
+    return;
+  }
+
+  const messages: Record<SessionClosedPayload["reason"], string> = {
+    cancelled: "The other peer cancelled the session",
+    peer_disconnected: "The other peer left the session",
+    pin_locked: "Too many PIN attempts, the session is locked",
+  };
+  handleDisplayStatusChange("Session closed");
+  handleSessionResponseError(messages[detail.reason]);
+  signallingChannel.close();
+});
+
+signallingEmitter.addEventListener(SignalingEvent.SESSION_EXPIRED, () => {
+  if (localPeer !== null && localPeer.getState() >= PeerState.CONNECTED) {
+    return;
+  }
+
+  handleDisplayStatusChange("Session expired");
+  handleSessionResponseError("The session expired, please start a new one");
+  signallingChannel.close();
+});
+
+window.addEventListener("pagehide", () => {
+  if (localPeer === null || localPeer.getState() < PeerState.CONNECTED) {
+    signallingChannel.cancelSession();
+  }
+});
+
 peerEmitter.addEventListener(PeerEvent.PEER_STATUS_CHANGED, (event) => {
   const { detail } = event as CustomEvent<{ status: string }>;
   handleDisplayStatusChange(detail.status);